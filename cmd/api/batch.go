@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/manunio/greenlight/internal/data"
+	"github.com/manunio/greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+// maxBatchOperations is the largest number of operations a single batch can contain.
+const maxBatchOperations = 100
+
+// batchTimeout bounds the transaction of a batch, leaving time to write the results
+// within the server's WriteTimeout.
+const batchTimeout = 25 * time.Second
+
+// batchOperation is a single operation of a batch request. The movie holds the fields
+// of a new movie for the create operation, and the fields to change for the patch
+// operation. The patch and delete operations only go ahead if the movie still has the
+// given version.
+type batchOperation struct {
+	Op      string `json:"op"`
+	ID      int64  `json:"id"`
+	Version int32  `json:"version"`
+	Movie   struct {
+		Title   *string       `json:"title"`
+		Year    *int32        `json:"year"`
+		Runtime *data.Runtime `json:"runtime"`
+		Genres  []string      `json:"genres"`
+		ImdbID  *string       `json:"imdb_id"`
+		TmdbID  *int64        `json:"tmdb_id"`
+		Titles  data.Titles   `json:"titles"`
+	} `json:"movie"`
+}
+
+// batchResult is the outcome of a single operation. The status is the one the
+// operation would have got as a request of its own, and the error has the same shape
+// as in the error responses.
+type batchResult struct {
+	Op      string      `json:"op"`
+	Status  int         `json:"status"`
+	Movie   *data.Movie `json:"movie,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Error   interface{} `json:"error,omitempty"`
+}
+
+// batchMoviesHandler runs an array of create, patch and delete operations in a single
+// transaction. The transaction is only committed if every operation succeeds,
+// otherwise none of the changes are saved and the response has the status of the
+// first failed operation.
+func (app *application) batchMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var operations []batchOperation
+
+	err := app.readJSON(w, r, &operations)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(operations) > 0, "operations", "must contain at least 1 operation")
+	v.Check(len(operations) <= maxBatchOperations, "operations", fmt.Sprintf("must not contain more than %d operations", maxBatchOperations))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), batchTimeout)
+	defer cancel()
+
+	tx, err := app.models.Movies.DB.BeginTx(ctx, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Rolling back a committed transaction is a no-op, so this makes sure that the
+	// transaction is always finished.
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	userID := app.contextGetUser(r).ID
+
+	results := make([]batchResult, len(operations))
+	failedStatus := 0
+
+	// Every operation is run, even after one has failed, so that the results list all
+	// the problems with the batch.
+	for i, op := range operations {
+		results[i], err = app.runBatchOperation(tx, op, userID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if failedStatus == 0 && results[i].Error != nil {
+			failedStatus = results[i].Status
+		}
+	}
+
+	if failedStatus == 0 {
+		err = tx.Commit()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		// Nothing was saved, so the operations which succeeded didn't really happen.
+		for i := range results {
+			if results[i].Error == nil {
+				results[i] = batchResult{
+					Op:     results[i].Op,
+					Status: http.StatusFailedDependency,
+					Error:  "the operation was not applied because another operation in the batch failed",
+				}
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if failedStatus != 0 {
+		status = failedStatus
+	}
+
+	err = app.writeJSON(w, status, envelope{"committed": failedStatus == 0, "results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runBatchOperation runs a single operation of a batch inside the transaction tx. Only
+// unexpected errors are returned, the failures of the operation itself are reported in
+// the result.
+func (app *application) runBatchOperation(tx *sql.Tx, op batchOperation, userID int64) (batchResult, error) {
+	result := batchResult{Op: op.Op}
+
+	v := validator.New()
+
+	v.Check(validator.In(op.Op, "create", "patch", "delete"), "op", "must be create, patch or delete")
+
+	if op.Op == "patch" || op.Op == "delete" {
+		v.Check(op.ID > 0, "id", "must be provided")
+		v.Check(op.Version > 0, "version", "must be provided")
+	}
+
+	if !v.Valid() {
+		return failedValidationResult(result, v.Errors), nil
+	}
+
+	var movie *data.Movie
+
+	if op.Op == "create" {
+		movie = &data.Movie{}
+	} else {
+		var err error
+
+		// The movie is locked until the end of the transaction, so the version we
+		// check here is the one which gets updated or deleted.
+		movie, err = app.models.Movies.GetForUpdate(tx, op.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				result.Status = http.StatusNotFound
+				result.Error = "the requested resource could not be found"
+				return result, nil
+			default:
+				return batchResult{}, err
+			}
+		}
+
+		if movie.Version != op.Version {
+			return editConflictResult(result), nil
+		}
+	}
+
+	if op.Op == "delete" {
+		err := app.models.Movies.DeleteVersion(tx, movie.ID, movie.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				return editConflictResult(result), nil
+			default:
+				return batchResult{}, err
+			}
+		}
+
+		result.Status = http.StatusOK
+		result.Message = "movie successfully deleted"
+		return result, nil
+	}
+
+	if op.Movie.Title != nil {
+		movie.Title = *op.Movie.Title
+	}
+
+	if op.Movie.Year != nil {
+		movie.Year = *op.Movie.Year
+	}
+
+	if op.Movie.Runtime != nil {
+		movie.Runtime = *op.Movie.Runtime
+	}
+
+	if op.Movie.Genres != nil {
+		movie.Genres = op.Movie.Genres
+
+		err := app.normalizeGenres(v, movie)
+		if err != nil {
+			return batchResult{}, err
+		}
+	}
+
+	if op.Movie.ImdbID != nil {
+		movie.ImdbID = *op.Movie.ImdbID
+	}
+
+	if op.Movie.TmdbID != nil {
+		movie.TmdbID = *op.Movie.TmdbID
+	}
+
+	if op.Movie.Titles != nil {
+		movie.Titles = op.Movie.Titles
+	}
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		return failedValidationResult(result, v.Errors), nil
+	}
+
+	if op.Op == "create" {
+		err := app.models.Movies.Insert(tx, movie, userID)
+		if err != nil {
+			if idErrors := externalIDErrors(err); idErrors != nil {
+				return failedValidationResult(result, idErrors), nil
+			}
+			return batchResult{}, err
+		}
+
+		result.Status = http.StatusCreated
+		result.Movie = movie
+		return result, nil
+	}
+
+	err := app.models.Movies.Update(tx, movie, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return editConflictResult(result), nil
+		case externalIDErrors(err) != nil:
+			return failedValidationResult(result, externalIDErrors(err)), nil
+		default:
+			return batchResult{}, err
+		}
+	}
+
+	result.Status = http.StatusOK
+	result.Movie = movie
+	return result, nil
+}
+
+// failedValidationResult reports a failed operation in the same way as
+// failedValidationResponse().
+func failedValidationResult(result batchResult, errors map[string]string) batchResult {
+	result.Status = http.StatusUnprocessableEntity
+	result.Error = errors
+	return result
+}
+
+// editConflictResult reports a failed operation in the same way as
+// editConflictResponse().
+func editConflictResult(result batchResult) batchResult {
+	result.Status = http.StatusConflict
+	result.Error = "unable to update the record due to an edit conflict, please try again"
+	return result
+}
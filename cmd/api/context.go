@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"github.com/manunio/greenlight/internal/data"
+	"net"
 	"net/http"
+	"time"
 )
 
 type contextKey string
@@ -13,6 +15,10 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// connContextKey is the key of the connection a request came in on, which the server
+// stores in the context of every connection (see serve()).
+const connContextKey = contextKey("conn")
+
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
@@ -26,3 +32,33 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// contextSetConn returns a copy of the connection context ctx which holds the
+// connection c. It is used as the ConnContext function of the server.
+func (app *application) contextSetConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey, c)
+}
+
+// extendDeadlines moves the read and write deadlines of the connection of the request
+// to the given durations from now, for the few handlers which may legitimately take
+// longer than the server's ReadTimeout and WriteTimeout. A zero duration leaves that
+// deadline as it is.
+func (app *application) extendDeadlines(r *http.Request, read, write time.Duration) error {
+	conn, ok := r.Context().Value(connContextKey).(net.Conn)
+	if !ok {
+		panic("missing conn value in request context")
+	}
+
+	if read > 0 {
+		err := conn.SetReadDeadline(time.Now().Add(read))
+		if err != nil {
+			return err
+		}
+	}
+
+	if write > 0 {
+		return conn.SetWriteDeadline(time.Now().Add(write))
+	}
+
+	return nil
+}
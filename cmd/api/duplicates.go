@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"github.com/manunio/greenlight/internal/data"
+	"github.com/manunio/greenlight/internal/validator"
+	"net/http"
+)
+
+// externalIDErrors returns the validation errors for a movie write which failed because
+// another movie already has one of its external IDs, or nil for any other error.
+func externalIDErrors(err error) map[string]string {
+	switch {
+	case errors.Is(err, data.ErrDuplicateImdbID):
+		return map[string]string{"imdb_id": "is already used by another movie"}
+	case errors.Is(err, data.ErrDuplicateTmdbID):
+		return map[string]string{"tmdb_id": "is already used by another movie"}
+	default:
+		return nil
+	}
+}
+
+// mergeMovieHandler folds the movie given by the :id parameter, which is a duplicate,
+// into another movie which survives it. See data.MovieModel.Merge() for what is moved
+// over. The duplicate ends up in the trash.
+func (app *application) mergeMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Into int64 `json:"into"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Into > 0, "into", "must be provided")
+	v.Check(input.Into != id, "into", "must be a different movie")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Check the survivor separately, so that a missing survivor is reported as a
+	// validation error rather than as the movie in the URL not being found.
+	_, err = app.models.Movies.GetFields(input.Into, []string{"id"})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("into", "must refer to an existing movie")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movie, err := app.models.Movies.Merge(id, input.Into, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", app.movieETag(movie, nil, ""))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
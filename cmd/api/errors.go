@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/manunio/greenlight/internal/data"
 	"net/http"
 )
 
@@ -53,6 +54,42 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+// duplicateMovieResponse points the client at the existing movie which the movie it
+// tried to create is a duplicate of.
+func (app *application) duplicateMovieResponse(w http.ResponseWriter, r *http.Request, existing *data.Movie) {
+	message := "a movie with the same external ID, or the same title and year, already exists"
+
+	headers := make(http.Header)
+
+	// A movie in the trash can't be fetched until it is restored, so there's nothing
+	// to link to.
+	if existing.DeletedAt != nil {
+		message = "a movie with the same external ID already exists in the trash"
+	} else {
+		headers.Set("Location", fmt.Sprintf("/v1/movies/%d", existing.ID))
+	}
+
+	env := envelope{
+		"error": message,
+		"movie": existing,
+	}
+
+	if err := app.writeJSON(w, http.StatusConflict, env, headers); err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has been modified since it was fetched, please fetch it again and retry"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("the %s content type is not supported for this resource", r.Header.Get("Content-Type"))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
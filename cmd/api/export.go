@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/manunio/greenlight/internal/data"
+	"github.com/manunio/greenlight/internal/validator"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFlushInterval is the number of movies written between flushes of the export
+// to the client.
+const exportFlushInterval = 500
+
+// exportWriteTimeout is how long writing each batch of exportFlushInterval movies may
+// take. It stands in for the server's WriteTimeout, which would otherwise cut off any
+// export taking longer than that as a whole.
+const exportWriteTimeout = 30 * time.Second
+
+// movieExportWriter writes a single movie of an export.
+type movieExportWriter func(movie *data.Movie) error
+
+// sentWriter records whether anything has been written through it to the response,
+// which means that the status code has been sent.
+type sentWriter struct {
+	io.Writer
+	sent bool
+}
+
+func (sw *sentWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		sw.sent = true
+	}
+
+	return sw.Writer.Write(p)
+}
+
+// exportMoviesHandler streams every movie matching the search as CSV or NDJSON. Unlike
+// the other handlers it doesn't use writeJSON(), as that would need the whole export in
+// memory. Instead each movie is written to the response as soon as it is read from the
+// database.
+//
+// As the status code is sent before the export is done, the Export-Status trailer
+// tells clients whether they got all of it: it is "complete" (along with the number of
+// movies in the Export-Count trailer) at the end of a finished export, and "incomplete"
+// if the export failed partway through. An export which was cut off, like by a dropped
+// connection, has no trailers at all.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	search := app.readMovieSearch(qs, v)
+
+	filters := data.Filters{
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafelist: movieSortSafelist,
+	}
+
+	format := app.readString(qs, "format", "csv")
+
+	data.ValidateMovieSearch(v, search)
+	data.ValidateSort(v, filters)
+
+	v.Check(search.Title != "" || !filters.SortsBy("relevance"), "sort", "relevance can only be used together with title")
+	v.Check(validator.In(format, "csv", "ndjson"), "format", "must be csv or ndjson")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// As in the movie listing, genre aliases are searched for as the canonical genre.
+	var err error
+
+	search.Genres, _, err = app.models.Genres.Normalize(search.Genres)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The movies are buffered before they reach the response, so it's only too late to
+	// send an error response once the buffer has been written out.
+	out := &sentWriter{Writer: w}
+	buf := bufio.NewWriter(out)
+
+	var write movieExportWriter
+	var flush func() error
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		write, flush = app.csvMovieWriter(buf)
+	default:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		write, flush = app.ndjsonMovieWriter(buf)
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="movies.`+format+`"`)
+	w.Header().Set("Trailer", "Export-Status, Export-Count")
+
+	flusher, _ := w.(http.Flusher)
+
+	// The write deadline is pushed forward every time a batch of movies has been
+	// flushed, rather than applying to the export as a whole.
+	err = app.extendDeadlines(r, 0, exportWriteTimeout)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	written := 0
+
+	err = app.models.Movies.Export(r.Context(), search, filters, func(movie *data.Movie) error {
+		err := write(movie)
+		if err != nil {
+			return err
+		}
+
+		written++
+
+		if written%exportFlushInterval == 0 {
+			err = flush()
+			if err != nil {
+				return err
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			return app.extendDeadlines(r, 0, exportWriteTimeout)
+		}
+
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		if !out.sent {
+			w.Header().Del("Content-Disposition")
+			w.Header().Del("Trailer")
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.logError(r, err)
+
+		// Send the movies which are still buffered along with the ones already sent.
+		// This fails too if it was writing to the client which failed, which is
+		// already logged.
+		_ = flush()
+
+		w.Header().Set("Export-Status", "incomplete")
+		return
+	}
+
+	w.Header().Set("Export-Status", "complete")
+	w.Header().Set("Export-Count", strconv.Itoa(written))
+}
+
+// csvMovieWriter writes the movies as CSV with a header row. The runtime is written as
+// a plain number of minutes and the genres are separated by commas within their field,
+// which is the format the CSV import reads.
+func (app *application) csvMovieWriter(buf *bufio.Writer) (movieExportWriter, func() error) {
+	writer := csv.NewWriter(buf)
+	header := false
+
+	writeHeader := func() error {
+		header = true
+		return writer.Write([]string{"id", "title", "year", "runtime", "genres", "imdb_id", "tmdb_id", "version"})
+	}
+
+	write := func(movie *data.Movie) error {
+		if !header {
+			err := writeHeader()
+			if err != nil {
+				return err
+			}
+		}
+
+		return writer.Write([]string{
+			strconv.FormatInt(movie.ID, 10),
+			movie.Title,
+			strconv.FormatInt(int64(movie.Year), 10),
+			strconv.FormatInt(int64(movie.Runtime), 10),
+			strings.Join(movie.Genres, ","),
+			movie.ImdbID,
+			tmdbIDField(movie.TmdbID),
+			strconv.FormatInt(int64(movie.Version), 10),
+		})
+	}
+
+	flush := func() error {
+		// An empty export still gets the header row.
+		if !header {
+			err := writeHeader()
+			if err != nil {
+				return err
+			}
+		}
+
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+
+		return buf.Flush()
+	}
+
+	return write, flush
+}
+
+// ndjsonMovieWriter writes the movies as newline-delimited JSON, with each line holding
+// a movie in the same format as the other endpoints.
+func (app *application) ndjsonMovieWriter(buf *bufio.Writer) (movieExportWriter, func() error) {
+	enc := json.NewEncoder(buf)
+
+	write := func(movie *data.Movie) error {
+		return enc.Encode(movie)
+	}
+
+	return write, buf.Flush
+}
+
+// tmdbIDField formats the TMDB ID of a movie for the CSV export, leaving the field empty
+// for movies without one.
+func tmdbIDField(id int64) string {
+	if id == 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(id, 10)
+}
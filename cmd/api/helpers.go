@@ -1,16 +1,20 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"github.com/manunio/greenlight/internal/data"
 	"github.com/manunio/greenlight/internal/validator"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type envelope map[string]interface{}
@@ -26,6 +30,101 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// readVersionParam reads the :version parameter of routes like
+// /v1/movies/:id/versions/:version.
+func (app *application) readVersionParam(r *http.Request) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	version, err := strconv.ParseInt(params.ByName("version"), 10, 32)
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid version parameter")
+	}
+
+	return int32(version), nil
+}
+
+// movieETag returns the entity tag for a representation of the movie, restricted to
+// the given fields (if any) and with its title in the given locale (if any, see
+// localizeMovie()). It is made of the version of the movie, which the If-Match
+// preconditions are checked against (see versionMatches()), and a digest of everything
+// else that the representation depends on, so that each representation of a version
+// has a tag of its own.
+func (app *application) movieETag(movie *data.Movie, fields []string, locale string) string {
+	// Reviews change the rating of a movie, and uploads its poster, without making a
+	// new version of it.
+	parts := []string{
+		fmt.Sprintf("rating=%d/%g", movie.RatingCount, movie.AverageRating),
+		"poster=" + movie.PosterID,
+		"locale=" + locale,
+	}
+
+	if len(fields) > 0 {
+		// The fields are sent back as a JSON object whatever order they were asked
+		// for in.
+		sorted := append([]string{}, fields...)
+		sort.Strings(sorted)
+
+		parts = append(parts, "fields="+strings.Join(sorted, "+"))
+	}
+
+	digest := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+
+	return fmt.Sprintf(`"%d-%x"`, movie.Version, digest[:8])
+}
+
+// versionMatches reports whether one of the entity tags listed in the value of an
+// If-Match header is for the given version of a movie (see movieETag()), whichever
+// representation of it the tag is for. The "*" value matches any version, and weak
+// tags never match.
+func (app *application) versionMatches(header string, version int32) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+
+		if tag == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(tag, "W/") || !strings.HasPrefix(tag, `"`) {
+			continue
+		}
+
+		tag = strings.SplitN(strings.Trim(tag, `"`), "-", 2)[0]
+
+		if tag == strconv.Itoa(int(version)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// etagMatches reports whether etag is listed in the value of an If-Match or
+// If-None-Match header. The "*" value matches any etag. If weak is true the W/ prefix
+// of the listed tags is ignored (the weak comparison used for If-None-Match),
+// otherwise weak tags never match (the strong comparison used for If-Match).
+func (app *application) etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+
+		if tag == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+
+		if tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
 	js, err := json.Marshal(data)
 	if err != nil {
@@ -45,6 +144,30 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data interf
 	return nil
 }
 
+// pickFields returns the JSON object representation of v with only the given keys
+// kept, which is used to send sparse fieldsets to the client.
+func (app *application) pickFields(v interface{}, fields []string) (map[string]json.RawMessage, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]json.RawMessage
+
+	err = json.Unmarshal(js, &object)
+	if err != nil {
+		return nil, err
+	}
+
+	for key := range object {
+		if !validator.In(key, fields...) {
+			delete(object, key)
+		}
+	}
+
+	return object, nil
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	// Use http.MaxBytesReader to limit the size of the request body to 1MB.
 	maxBytes := 1_048_576
@@ -152,6 +275,61 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readBool reads a boolean value like "true" or "false" from the query string.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// readRuntime reads a runtime in the "<runtime> mins" format from the query string,
+// adding an error to the validator if it can't be parsed.
+func (app *application) readRuntime(qs url.Values, key string, defaultValue data.Runtime, v *validator.Validator) data.Runtime {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	runtime, err := data.ParseRuntime(s)
+	if err != nil {
+		v.AddError(key, `must be in the format "<runtime> mins"`)
+		return defaultValue
+	}
+
+	return runtime
+}
+
+// readTime reads a timestamp from the query string. Both full RFC 3339 timestamps and
+// plain dates like "2021-06-30" (which are taken as midnight UTC) are accepted.
+func (app *application) readTime(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t
+		}
+	}
+
+	v.AddError(key, "must be a RFC 3339 timestamp or a date in the format YYYY-MM-DD")
+	return defaultValue
+}
+
 // background method runs a goroutine as an anonymous function which runs passed fn func(),
 // which also recovers any unhandled panic in defer block of anonymous func.
 func (app *application) background(fn func()) {
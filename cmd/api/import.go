@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/manunio/greenlight/internal/data"
+	"github.com/manunio/greenlight/internal/validator"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Import modes. In the atomic mode all the rows are inserted in a single transaction
+// which is only committed if every row is valid. In the best effort mode each valid
+// row is inserted on its own, and invalid rows are skipped.
+const (
+	importModeAtomic     = "atomic"
+	importModeBestEffort = "best_effort"
+)
+
+// importTimeout is how long an import may take, from reading the body to writing the
+// report. It is longer than the server's timeouts, which this route extends.
+const importTimeout = 5 * time.Minute
+
+// importRow is the outcome of importing a single row, as sent back in the report.
+type importRow struct {
+	Row    int               `json:"row"`
+	Status string            `json:"status"`
+	ID     int64             `json:"id,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// importReport is the response to an import request.
+type importReport struct {
+	Mode      string      `json:"mode"`
+	Committed bool        `json:"committed"`
+	Total     int         `json:"total"`
+	Accepted  int         `json:"accepted"`
+	Rejected  int         `json:"rejected"`
+	Rows      []importRow `json:"rows"`
+}
+
+// movieRowReader returns the next movie read from an import body, or io.EOF once there
+// are no more rows. If the row can't be turned into a movie, the problems are returned
+// in the rowErrors map instead (which doesn't stop the import). An error means that the
+// body can't be read any further.
+type movieRowReader func() (movie *data.Movie, rowErrors map[string]string, err error)
+
+// parsedMovieRow is a row of an import body, read before any of the rows is imported.
+type parsedMovieRow struct {
+	movie     *data.Movie
+	rowErrors map[string]string
+}
+
+func (app *application) importMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	mode := app.readString(r.URL.Query(), "mode", importModeAtomic)
+
+	v.Check(validator.In(mode, importModeAtomic, importModeBestEffort), "mode", "must be atomic or best_effort")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
+
+	// A large import takes longer than the server's timeouts allow, both to upload and
+	// to insert.
+	err = app.extendDeadlines(r, importTimeout, importTimeout)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Limit the size of the request body to 10MB, which is plenty for tens of
+	// thousands of movies.
+	maxBytes := 10_485_760
+	body := http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	var next movieRowReader
+
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson":
+		next = app.ndjsonMovieReader(body, maxBytes)
+	case "text/csv":
+		next, err = app.csvMovieReader(body)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	default:
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
+
+	// Read the whole body (which is at most 10MB) before touching the database, so
+	// that a slow upload doesn't hold a transaction open, and a broken one doesn't
+	// leave a partial import behind.
+	var rows []parsedMovieRow
+
+	for {
+		movie, rowErrors, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// In the best effort mode the row which couldn't be read is rejected like
+			// any other bad row, and the rows before it are still imported. The body
+			// can't be read any further though, so that's the last row.
+			if mode == importModeBestEffort {
+				rows = append(rows, parsedMovieRow{rowErrors: map[string]string{"row": err.Error()}})
+				break
+			}
+
+			app.badRequestResponse(w, r, fmt.Errorf("row %d: %w", len(rows)+1, err))
+			return
+		}
+
+		rows = append(rows, parsedMovieRow{movie, rowErrors})
+	}
+
+	var tx *sql.Tx
+
+	if mode == importModeAtomic {
+		ctx, cancel := context.WithTimeout(r.Context(), importTimeout)
+		defer cancel()
+
+		tx, err = app.models.Movies.DB.BeginTx(ctx, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Rolling back a committed transaction is a no-op, so this makes sure that
+		// the transaction is always finished.
+		defer func() {
+			_ = tx.Rollback()
+		}()
+	}
+
+	userID := app.contextGetUser(r).ID
+
+	report := importReport{Mode: mode, Rows: []importRow{}}
+
+	for _, parsed := range rows {
+		movie, rowErrors := parsed.movie, parsed.rowErrors
+
+		report.Total++
+		row := importRow{Row: report.Total}
+
+		if rowErrors == nil {
+			v := validator.New()
+
+			err = app.normalizeGenres(v, movie)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if data.ValidateMovie(v, movie); !v.Valid() {
+				rowErrors = v.Errors
+			}
+		}
+
+		if rowErrors != nil {
+			row.Status = "rejected"
+			row.Errors = rowErrors
+			report.Rejected++
+			report.Rows = append(report.Rows, row)
+			continue
+		}
+
+		// In the atomic mode there's no point in inserting any more rows once one has
+		// been rejected, as the transaction will be rolled back. We still validate the
+		// remaining rows so that the report lists every problem.
+		if mode == importModeBestEffort || report.Rejected == 0 {
+			err = app.models.Movies.Insert(tx, movie, userID)
+			if err != nil {
+				if rowErrors := externalIDErrors(err); rowErrors != nil {
+					row.Status = "rejected"
+					row.Errors = rowErrors
+					report.Rejected++
+					report.Rows = append(report.Rows, row)
+					continue
+				}
+
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			row.ID = movie.ID
+		}
+
+		row.Status = "accepted"
+		report.Accepted++
+		report.Rows = append(report.Rows, row)
+	}
+
+	switch {
+	case mode == importModeBestEffort:
+		report.Committed = report.Accepted > 0
+
+	case report.Rejected == 0:
+		err = tx.Commit()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		report.Committed = true
+
+	default:
+		// Nothing was saved, so the IDs the accepted rows were given are meaningless.
+		for i := range report.Rows {
+			report.Rows[i].ID = 0
+		}
+	}
+
+	status := http.StatusOK
+
+	switch {
+	case report.Committed:
+		status = http.StatusCreated
+	case mode == importModeAtomic && report.Rejected > 0:
+		status = http.StatusUnprocessableEntity
+	}
+
+	err = app.writeJSON(w, status, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// ndjsonMovieReader reads movies from newline-delimited JSON, where each line holds an
+// object in the same format as the body of a create movie request. Blank lines are
+// skipped.
+func (app *application) ndjsonMovieReader(body io.Reader, maxLineBytes int) movieRowReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+
+	return func() (*data.Movie, map[string]string, error) {
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+
+			var input struct {
+				Title   string       `json:"title"`
+				Year    int32        `json:"year"`
+				Runtime data.Runtime `json:"runtime"`
+				Genres  []string     `json:"genres"`
+				ImdbID  string       `json:"imdb_id"`
+				TmdbID  int64        `json:"tmdb_id"`
+				Titles  data.Titles  `json:"titles"`
+			}
+
+			dec := json.NewDecoder(bytes.NewReader(line))
+			dec.DisallowUnknownFields()
+
+			err := dec.Decode(&input)
+			if err != nil {
+				return nil, map[string]string{"row": fmt.Sprintf("contains invalid JSON: %s", err)}, nil
+			}
+
+			movie := &data.Movie{
+				Title:   input.Title,
+				Year:    input.Year,
+				Runtime: input.Runtime,
+				Genres:  input.Genres,
+				ImdbID:  input.ImdbID,
+				TmdbID:  input.TmdbID,
+				Titles:  input.Titles,
+			}
+
+			return movie, nil, nil
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		return nil, nil, io.EOF
+	}
+}
+
+// csvMovieReader reads movies from CSV with a header row naming the title, year,
+// runtime and genres columns (in any order). The runtime can be given either as
+// "<runtime> mins" or as a plain number of minutes, and the genres are separated by
+// commas within their field, e.g. "Drama,Romance". The imdb_id and tmdb_id columns are
+// optional. The id and version columns of a CSV export are allowed too, but ignored, as
+// the imported movies are always new ones.
+func (app *application) csvMovieReader(body io.Reader) (movieRowReader, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("body must not be empty")
+		}
+		return nil, err
+	}
+
+	columns := map[string]int{}
+
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		if !validator.In(name, "id", "title", "year", "runtime", "genres", "imdb_id", "tmdb_id", "version") {
+			return nil, fmt.Errorf("header contains unknown column %q", name)
+		}
+
+		columns[name] = i
+	}
+
+	for _, name := range []string{"title", "year", "runtime", "genres"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("header must contain a %q column", name)
+		}
+	}
+
+	return func() (*data.Movie, map[string]string, error) {
+		record, err := reader.Read()
+		if err != nil {
+			var parseError *csv.ParseError
+
+			if errors.As(err, &parseError) {
+				return nil, map[string]string{"row": parseError.Err.Error()}, nil
+			}
+
+			return nil, nil, err
+		}
+
+		if len(record) != len(header) {
+			return nil, map[string]string{"row": fmt.Sprintf("must have %d fields", len(header))}, nil
+		}
+
+		rowErrors := map[string]string{}
+
+		movie := &data.Movie{
+			Title: record[columns["title"]],
+		}
+
+		year, err := strconv.ParseInt(strings.TrimSpace(record[columns["year"]]), 10, 32)
+		if err != nil {
+			rowErrors["year"] = "must be an integer value"
+		}
+		movie.Year = int32(year)
+
+		runtime := strings.TrimSpace(record[columns["runtime"]])
+
+		if minutes, err := strconv.ParseInt(runtime, 10, 32); err == nil {
+			movie.Runtime = data.Runtime(minutes)
+		} else if movie.Runtime, err = data.ParseRuntime(runtime); err != nil {
+			rowErrors["runtime"] = `must be a number of minutes or in the format "<runtime> mins"`
+		}
+
+		if genres := strings.TrimSpace(record[columns["genres"]]); genres != "" {
+			movie.Genres = strings.Split(genres, ",")
+			for i := range movie.Genres {
+				movie.Genres[i] = strings.TrimSpace(movie.Genres[i])
+			}
+		}
+
+		// The external IDs are optional, and so are their columns.
+		if i, ok := columns["imdb_id"]; ok {
+			movie.ImdbID = strings.TrimSpace(record[i])
+		}
+
+		if i, ok := columns["tmdb_id"]; ok {
+			if tmdbID := strings.TrimSpace(record[i]); tmdbID != "" {
+				movie.TmdbID, err = strconv.ParseInt(tmdbID, 10, 64)
+				if err != nil {
+					rowErrors["tmdb_id"] = "must be an integer value"
+				}
+			}
+		}
+
+		if len(rowErrors) > 0 {
+			return nil, rowErrors, nil
+		}
+
+		return movie, nil, nil
+	}, nil
+}
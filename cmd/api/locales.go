@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/manunio/greenlight/internal/data"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// readLocales returns the locales the client wants movie titles in, most preferred
+// first. The lang query string parameter (a comma-separated list like "de-AT,de") takes
+// precedence over the Accept-Language header.
+func (app *application) readLocales(r *http.Request) []string {
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		locales := []string{}
+
+		for _, locale := range strings.Split(lang, ",") {
+			if locale = strings.TrimSpace(locale); locale != "" {
+				locales = append(locales, locale)
+			}
+		}
+
+		return locales
+	}
+
+	return parseAcceptLanguage(r.Header.Get("Accept-Language"))
+}
+
+// parseAcceptLanguage returns the language ranges of an Accept-Language header like
+// "de-AT, de;q=0.9, en;q=0.5", sorted by their quality values. The wildcard and the
+// ranges with a quality of 0 are left out, and so are malformed entries.
+func parseAcceptLanguage(header string) []string {
+	type languageRange struct {
+		tag     string
+		quality float64
+	}
+
+	var ranges []languageRange
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+
+		tag := strings.TrimSpace(params[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					q = 0
+				}
+				quality = q
+			}
+		}
+
+		if quality <= 0 {
+			continue
+		}
+
+		ranges = append(ranges, languageRange{tag, quality})
+	}
+
+	// A stable sort keeps the ranges with the same quality in the order given.
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].quality > ranges[j].quality
+	})
+
+	locales := make([]string, len(ranges))
+	for i := range ranges {
+		locales[i] = ranges[i].tag
+	}
+
+	return locales
+}
+
+// localizeMovies replaces the titles of the movies with their localized titles in the
+// locales the client asked for (see readLocales()). The response is marked as varying
+// by Accept-Language either way, so that caches don't mix up the languages.
+func (app *application) localizeMovies(w http.ResponseWriter, r *http.Request, movies ...*data.Movie) {
+	w.Header().Add("Vary", "Accept-Language")
+
+	locales := app.readLocales(r)
+	if len(locales) == 0 {
+		return
+	}
+
+	for _, movie := range movies {
+		movie.Localize(locales)
+	}
+}
+
+// localizeMovie is localizeMovies() for a single movie, which also returns the locale
+// of the title used (see data.Movie.Localize()), or "" if the title wasn't localized.
+func (app *application) localizeMovie(w http.ResponseWriter, r *http.Request, movie *data.Movie) string {
+	w.Header().Add("Vary", "Accept-Language")
+
+	return movie.Localize(app.readLocales(r))
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/manunio/greenlight/internal/data"
 	"github.com/manunio/greenlight/internal/jsonlog"
 	"github.com/manunio/greenlight/internal/mailer"
+	"github.com/manunio/greenlight/internal/storage"
 	"os"
 	"sync"
 	"time"
@@ -36,6 +37,22 @@ type config struct {
 		burst   int
 		enabled bool
 	}
+	// trash struct holds how long deleted movies are kept before they are purged, and
+	// how often we check for movies to purge. A retention of zero disables purging.
+	trash struct {
+		retention     time.Duration
+		purgeInterval time.Duration
+	}
+	// stats struct holds how often the catalog statistics are recomputed. An interval
+	// of zero disables the refreshing.
+	stats struct {
+		refreshInterval time.Duration
+	}
+	// storage struct holds the directory where uploaded files, like movie posters, are
+	// kept.
+	storage struct {
+		dir string
+	}
 	// smtp struct holds SMTP server settings
 	smtp struct {
 		host     string
@@ -51,6 +68,8 @@ type application struct {
 	logger *jsonlog.Logger
 	models data.Models
 	mailer mailer.Mailer
+	// storage holds the uploaded files, like movie posters.
+	storage storage.Storage
 	// The zero-value for a sync.WaitGroup type is a valid, usable,
 	// sync.WaitGroup with a 'counter' value of 0, so we don't need
 	// to do anything else to initialize it before we can use it.
@@ -74,6 +93,16 @@ func main() {
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
+	// Trash related flags
+	flag.DurationVar(&cfg.trash.retention, "trash-retention", 30*24*time.Hour, "How long deleted movies are kept in the trash (0 keeps them forever)")
+	flag.DurationVar(&cfg.trash.purgeInterval, "trash-purge-interval", time.Hour, "How often to purge expired movies from the trash")
+
+	// Stats related flags
+	flag.DurationVar(&cfg.stats.refreshInterval, "stats-refresh-interval", 5*time.Minute, "How often to recompute the catalog statistics (0 disables refreshing)")
+
+	// Storage related flags
+	flag.StringVar(&cfg.storage.dir, "storage-dir", "./uploads", "Directory for uploaded files")
+
 	// Smtp server credential flags,
 	// uses mailtrap credentials as default values.
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
@@ -105,6 +134,11 @@ func main() {
 
 	logger.PrintInfo("database connection pool established", nil)
 
+	store, err := storage.NewLocal(cfg.storage.dir)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	app := &application{
 		config: cfg,
 		logger: logger,
@@ -116,6 +150,7 @@ func main() {
 			cfg.smtp.password,
 			cfg.smtp.sender,
 		),
+		storage: store,
 	}
 
 	err = app.serve()
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/manunio/greenlight/internal/data"
+	"github.com/manunio/greenlight/internal/patch"
 	"github.com/manunio/greenlight/internal/validator"
+	"mime"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
@@ -14,6 +21,12 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		Year    int32        `json:"year"`
 		Runtime data.Runtime `json:"runtime"`
 		Genres  []string     `json:"genres"`
+		ImdbID  string       `json:"imdb_id"`
+		TmdbID  int64        `json:"tmdb_id"`
+		Titles  data.Titles  `json:"titles"`
+		// The releases are optional, and can be replaced later through
+		// /v1/movies/:id/releases.
+		Releases []*data.Release `json:"releases"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -24,15 +37,31 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Copy the values from the input struct to a new Movie struct.
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:    input.Title,
+		Year:     input.Year,
+		Runtime:  input.Runtime,
+		Genres:   input.Genres,
+		ImdbID:   input.ImdbID,
+		TmdbID:   input.TmdbID,
+		Titles:   input.Titles,
+		Releases: input.Releases,
 	}
 
 	// Initialize a new Validator instance.
 	v := validator.New()
 
+	// Map the genres onto the taxonomy before validating, so that aliases like
+	// "Sci-Fi" are stored as the canonical genre.
+	err = app.normalizeGenres(v, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Movies which really do share a title and year with another one (like some
+	// remakes) can be created anyway with allow_duplicate=true.
+	allowDuplicate := app.readBool(r.URL.Query(), "allow_duplicate", false, v)
+
 	// Call the ValidateMovie() function and return a response containing the errors if
 	// any of the checks fail.
 	if data.ValidateMovie(v, movie); !v.Valid() {
@@ -40,14 +69,33 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Insert(movie)
+	// A movie with the same external ID, or the same title and year, is most likely
+	// already in the catalog, in which case the client is pointed at it instead.
+	existing, err := app.models.Movies.FindDuplicate(movie, !allowDuplicate)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if existing != nil {
+		app.duplicateMovieResponse(w, r, existing)
+		return
+	}
+
+	err = app.models.Movies.Insert(nil, movie, app.contextGetUser(r).ID)
 	if err != nil {
+		if idErrors := externalIDErrors(err); idErrors != nil {
+			app.failedValidationResponse(w, r, idErrors)
+			return
+		}
+
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("ETag", app.movieETag(movie, nil, ""))
 
 	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
 	if err != nil {
@@ -63,7 +111,18 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	v := validator.New()
+
+	// Only the fields listed in the fields parameter (if any) are selected and sent
+	// back to the client.
+	fields := app.readCSV(r.URL.Query(), "fields", []string{})
+
+	if data.ValidateFields(v, fields, data.MovieFieldSafelist); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.models.Movies.GetFields(id, fields)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -74,7 +133,33 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	// The title is sent in the client's language if the movie has a localized title
+	// for it.
+	locale := app.localizeMovie(w, r, movie)
+
+	// The ETag is derived from the version of the movie, the fields sent and the
+	// language of the title. If the client already has this representation (sent in
+	// the If-None-Match header) we only send back a 304 Not Modified response.
+	headers := make(http.Header)
+	headers.Set("ETag", app.movieETag(movie, fields, locale))
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && app.etagMatches(inm, headers.Get("ETag"), true) {
+		w.Header().Set("ETag", headers.Get("ETag"))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var body interface{} = movie
+
+	if len(fields) > 0 {
+		body, err = app.pickFields(movie, fields)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": body}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -102,74 +187,224 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Declare an input struct to hold the expected data from the client.
-	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
-	}
+	// If the client sent an If-Match header, it must match the ETag of (a
+	// representation of) the version of the movie which is stored now. Otherwise
+	// another client has changed the movie since it was fetched, and we send a 412
+	// Precondition Failed response instead of overwriting those changes.
+	ifMatch := r.Header.Get("If-Match")
 
-	// Read the JSON request body data into the input struct.
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
+	if ifMatch != "" && !app.versionMatches(ifMatch, movie.Version) {
+		app.preconditionFailedResponse(w, r)
 		return
 	}
 
-	// Copy the values from the request body to the appropriate fields of the movie
-	// record.
+	// The changes can be sent as a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC
+	// 6902), selected by the Content-Type header. Any other JSON body is read the way
+	// it always has been, with the fields which are present replacing those of the
+	// movie.
+	mediaType := "application/json"
 
-	// If the input.Title value is nil then we know that no corresponding "title" key/
-	// value pair was provided in the JSON request body. So we move on and leave the
-	// movie record unchanged. Otherwise, we update the movie record with the new title
-	// value. Importantly, because input.Title is a now a pointer to a string, we need
-	// to dereference the pointer using the * operator to get the underlying value
-	// before assigning it to our movie record.
-	if input.Title != nil {
-		movie.Title = *input.Title
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			app.badRequestResponse(w, r, errors.New("invalid Content-Type header"))
+			return
+		}
 	}
 
-	if input.Year != nil {
-		movie.Year = *input.Year
-	}
+	switch mediaType {
+	case "application/merge-patch+json", "application/json-patch+json":
+		err = app.patchMovie(w, r, mediaType, movie)
+		if err != nil {
+			switch {
+			case errors.Is(err, patch.ErrTestFailed):
+				app.editConflictResponse(w, r)
+			default:
+				app.badRequestResponse(w, r, err)
+			}
+			return
+		}
 
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
-	}
+	case "application/json":
+		// Declare an input struct to hold the expected data from the client.
+		var input struct {
+			Title   *string       `json:"title"`
+			Year    *int32        `json:"year"`
+			Runtime *data.Runtime `json:"runtime"`
+			Genres  []string      `json:"genres"`
+			ImdbID  *string       `json:"imdb_id"`
+			TmdbID  *int64        `json:"tmdb_id"`
+			Titles  data.Titles   `json:"titles"`
+		}
+
+		// Read the JSON request body data into the input struct.
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		// Copy the values from the request body to the appropriate fields of the movie
+		// record.
+
+		// If the input.Title value is nil then we know that no corresponding "title" key/
+		// value pair was provided in the JSON request body. So we move on and leave the
+		// movie record unchanged. Otherwise, we update the movie record with the new title
+		// value. Importantly, because input.Title is a now a pointer to a string, we need
+		// to dereference the pointer using the * operator to get the underlying value
+		// before assigning it to our movie record.
+		if input.Title != nil {
+			movie.Title = *input.Title
+		}
+
+		if input.Year != nil {
+			movie.Year = *input.Year
+		}
+
+		if input.Runtime != nil {
+			movie.Runtime = *input.Runtime
+		}
+
+		if input.Genres != nil {
+			movie.Genres = input.Genres // we don't need to dereference slice
+		}
+
+		if input.ImdbID != nil {
+			movie.ImdbID = *input.ImdbID
+		}
+
+		if input.TmdbID != nil {
+			movie.TmdbID = *input.TmdbID
+		}
 
-	if input.Genres != nil {
-		movie.Genres = input.Genres // we don't need to dereference slice
+		// Like the genres, the localized titles are replaced as a whole. A merge patch
+		// can change them one at a time.
+		if input.Titles != nil {
+			movie.Titles = input.Titles
+		}
+
+	default:
+		w.Header().Set("Accept-Patch", "application/json, application/merge-patch+json, application/json-patch+json")
+		app.unsupportedMediaTypeResponse(w, r)
+		return
 	}
 
 	// Validate the updated movie record, sending the client a 422 Unprocessable Entity
 	// response if any checks fail.
 	v := validator.New()
 
+	err = app.normalizeGenres(v, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	if data.ValidateMovie(v, movie); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Pass the updated movie record to our new Update() method.
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(nil, movie, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case externalIDErrors(err) != nil:
+			app.failedValidationResponse(w, r, externalIDErrors(err))
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
+	headers := make(http.Header)
+	headers.Set("ETag", app.movieETag(movie, nil, ""))
+
 	// Write the updated movie record in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// moviePatchDocument is the JSON document which merge patches and JSON patches of a
+// movie are applied to. It holds the fields of the movie which clients can change.
+type moviePatchDocument struct {
+	Title   string       `json:"title"`
+	Year    int32        `json:"year"`
+	Runtime data.Runtime `json:"runtime"`
+	Genres  []string     `json:"genres"`
+	ImdbID  string       `json:"imdb_id"`
+	TmdbID  int64        `json:"tmdb_id"`
+	Titles  data.Titles  `json:"titles"`
+}
+
+// patchMovie reads a JSON Merge Patch or JSON Patch (depending on mediaType) from the
+// request body, applies it to the movie and copies the result back into the movie.
+// Fields removed by the patch are left empty, so that ValidateMovie() catches them.
+func (app *application) patchMovie(w http.ResponseWriter, r *http.Request, mediaType string, movie *data.Movie) error {
+	var body json.RawMessage
+
+	err := app.readJSON(w, r, &body)
+	if err != nil {
+		return err
+	}
+
+	doc, err := json.Marshal(moviePatchDocument{
+		Title:   movie.Title,
+		Year:    movie.Year,
+		Runtime: movie.Runtime,
+		Genres:  movie.Genres,
+		ImdbID:  movie.ImdbID,
+		TmdbID:  movie.TmdbID,
+		Titles:  movie.Titles,
+	})
+	if err != nil {
+		return err
+	}
+
+	var patched []byte
+
+	if mediaType == "application/merge-patch+json" {
+		patched, err = patch.Merge(doc, body)
+	} else {
+		patched, err = patch.Apply(doc, body)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Decode the patched document into an empty document, so that a field which was
+	// removed by the patch doesn't keep its old value.
+	var result moviePatchDocument
+
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(&result)
+	if err != nil {
+		switch {
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			return fmt.Errorf("patch contains unknown key %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+		default:
+			return fmt.Errorf("patch results in an invalid movie: %w", err)
+		}
+	}
+
+	movie.Title = result.Title
+	movie.Year = result.Year
+	movie.Runtime = result.Runtime
+	movie.Genres = result.Genres
+	movie.ImdbID = result.ImdbID
+	movie.TmdbID = result.TmdbID
+	movie.Titles = result.Titles
+
+	return nil
+}
+
 func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the movie ID from the URL.
 	id, err := app.readIDParam(r)
@@ -178,59 +413,198 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// If the client sent an If-Match header, only delete the movie if it still has
+	// the version the client has seen, in the same way as for updates.
+	ifMatch := r.Header.Get("If-Match")
+
+	if ifMatch != "" {
+		movie, err := app.models.Movies.GetFields(id, []string{"version"})
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !app.versionMatches(ifMatch, movie.Version) {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+
+		err = app.models.Movies.DeleteVersion(nil, id, movie.Version)
+	} else {
+		err = app.models.Movies.Delete(nil, id)
+	}
+
 	// Delete the movie from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.Movies.Delete(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	// Return a 200 OK status code along with a success message.
+	// Return a 200 OK status code along with a success message. The movie is only moved
+	// to the trash, from where it can be restored until it is purged.
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// movieSortSafelist holds the sort values supported by the movie listing and export.
+var movieSortSafelist = []string{"id", "title", "year", "runtime", "relevance", "average_rating", "rating_count", "-id", "-title", "-year", "-runtime", "-relevance", "-average_rating", "-rating_count"}
+
+// readMovieSearch reads the filters of a movie search from the query string, which are
+// shared by the movie listing and export.
+func (app *application) readMovieSearch(qs url.Values, v *validator.Validator) data.MovieSearch {
+	return data.MovieSearch{
+		Title:            app.readString(qs, "title", ""),
+		Genres:           app.readCSV(qs, "genres", []string{}),
+		Fuzzy:            app.readBool(qs, "fuzzy", false, v),
+		YearMin:          app.readInt(qs, "year_min", 0, v),
+		YearMax:          app.readInt(qs, "year_max", 0, v),
+		RuntimeMin:       app.readRuntime(qs, "runtime_min", 0, v),
+		RuntimeMax:       app.readRuntime(qs, "runtime_max", 0, v),
+		CreatedAfter:     app.readTime(qs, "created_after", time.Time{}, v),
+		CreatedBefore:    app.readTime(qs, "created_before", time.Time{}, v),
+		PersonID:         int64(app.readInt(qs, "person_id", 0, v)),
+		ImdbID:           app.readString(qs, "imdb_id", ""),
+		TmdbID:           int64(app.readInt(qs, "tmdb_id", 0, v)),
+		ReleasedIn:       app.readString(qs, "released_in", ""),
+		MaxCertification: app.readString(qs, "max_certification", ""),
+	}
+}
+
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		data.MovieSearch
 		data.Filters
+		Facets []string
 	}
 
 	v := validator.New()
 
 	qs := r.URL.Query()
 
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.MovieSearch = app.readMovieSearch(qs, v)
+
+	input.Highlight = app.readBool(qs, "highlight", false, v)
+	input.HighlightStart = app.readString(qs, "highlight_start", "<b>")
+	input.HighlightStop = app.readString(qs, "highlight_stop", "</b>")
+
+	// Facets like "genres,year" are counted over all the movies matching the search
+	// and returned in the metadata.
+	input.Facets = app.readCSV(qs, "facets", []string{})
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
+	// The sort value may contain several comma-separated fields, e.g.
+	// "-year,title,-runtime", each of which is checked against the safelist.
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	// An opaque cursor taken from the next_cursor or prev_cursor metadata of a previous
+	// response switches the listing over to keyset pagination, in which case the page
+	// parameter is ignored.
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+
+	input.Filters.SortSafelist = movieSortSafelist
+
+	input.Filters.Fields = app.readCSV(qs, "fields", []string{})
+	input.Filters.FieldSafelist = data.MovieFieldSafelist
+
+	data.ValidateMovieSearch(v, input.MovieSearch)
+	data.ValidateFacets(v, input.Facets)
+
+	// Sorting by relevance only makes sense when there is a title to match against.
+	v.Check(input.Title != "" || !input.Filters.SortsBy("relevance"), "sort", "relevance can only be used together with title")
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	// The genres are searched for by their canonical slugs, so aliases are mapped onto
+	// those. Unknown genres are left as they are and simply don't match any movies.
+	var err error
+
+	input.Genres, _, err = app.models.Genres.Normalize(input.Genres)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	movies, metadata, err := app.models.Movies.GetAll(input.MovieSearch, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if len(input.Facets) > 0 {
+		metadata.Facets, err = app.models.Movies.GetFacets(input.MovieSearch, input.Facets)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.localizeMovies(w, r, movies...)
+
+	var body interface{} = movies
+
+	// When a sparse fieldset was requested we only send those fields, along with the
+	// relevance and highlight of title searches.
+	if len(input.Filters.Fields) > 0 {
+		fields := append(input.Filters.Fields, "relevance", "highlight")
+
+		sparse := make([]map[string]json.RawMessage, len(movies))
+		for i, movie := range movies {
+			sparse[i], err = app.pickFields(movie, fields)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		body = sparse
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": body, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) suggestMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	query := app.readString(qs, "q", "")
+	limit := app.readInt(qs, "limit", 10, v)
+
+	if data.ValidateSuggestQuery(v, query, limit); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := app.models.Movies.Suggest(query, limit)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
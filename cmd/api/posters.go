@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/manunio/greenlight/internal/data"
+	"github.com/manunio/greenlight/internal/storage"
+	"github.com/manunio/greenlight/internal/thumbnail"
+	"github.com/manunio/greenlight/internal/validator"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+)
+
+// Limits for uploaded posters. The dimensions are checked before the image is decoded,
+// so that a small file can't make us allocate a huge image.
+const (
+	maxPosterBytes     = 5 << 20
+	minPosterDimension = 100
+	maxPosterDimension = 6000
+)
+
+func (app *application) uploadPosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Check that the movie exists before doing any work on the image.
+	_, err = app.models.Movies.GetFields(id, []string{"id"})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Leave some room for the rest of the multipart body on top of the poster itself.
+	r.Body = http.MaxBytesReader(w, r.Body, maxPosterBytes+1<<20)
+
+	v := validator.New()
+
+	poster, err := app.readPosterPart(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errPosterTooLarge):
+			v.AddError("poster", "must not be larger than 5MB")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	v.Check(poster != nil, "poster", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The type is sniffed from the content rather than taken from the client.
+	v.Check(validator.In(http.DetectContentType(poster), "image/jpeg", "image/png", "image/gif"), "poster", "must be a JPEG, PNG or GIF image")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(poster))
+	if err != nil {
+		v.AddError("poster", "must be a valid image")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	v.Check(config.Width >= minPosterDimension && config.Height >= minPosterDimension, "poster", fmt.Sprintf("must be at least %d pixels wide and high", minPosterDimension))
+	v.Check(config.Width <= maxPosterDimension && config.Height <= maxPosterDimension, "poster", fmt.Sprintf("must not be more than %d pixels wide or high", maxPosterDimension))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(poster))
+	if err != nil {
+		v.AddError("poster", "must be a valid image")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	posterID, err := generatePosterID()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	prefix := posterPrefix(id, posterID)
+
+	err = app.storePoster(prefix, poster, img)
+	if err != nil {
+		app.deletePoster(r, prefix)
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	oldPosterID, err := app.models.Movies.SetPoster(id, posterID)
+	if err != nil {
+		app.deletePoster(r, prefix)
+
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if oldPosterID != "" {
+		app.deletePoster(r, posterPrefix(id, oldPosterID))
+	}
+
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+var errPosterTooLarge = errors.New("poster too large")
+
+// readPosterPart reads the poster from the "poster" field of a multipart/form-data
+// body, skipping any other fields. It returns nil if there is no poster field, and
+// errPosterTooLarge if the poster is larger than maxPosterBytes.
+func (app *application) readPosterPart(r *http.Request) ([]byte, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, errors.New("body must be multipart/form-data")
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			if err.Error() == "http: request body too large" {
+				return nil, errPosterTooLarge
+			}
+			return nil, err
+		}
+
+		if part.FormName() != "poster" {
+			continue
+		}
+
+		// Read one byte more than allowed, so that we can tell when the poster is
+		// too large.
+		poster, err := io.ReadAll(io.LimitReader(part, maxPosterBytes+1))
+		if err != nil {
+			if err.Error() == "http: request body too large" {
+				return nil, errPosterTooLarge
+			}
+			return nil, err
+		}
+
+		if len(poster) > maxPosterBytes {
+			return nil, errPosterTooLarge
+		}
+
+		return poster, nil
+	}
+}
+
+// storePoster stores the uploaded poster as it is, along with a JPEG thumbnail for
+// each of the poster sizes.
+func (app *application) storePoster(prefix string, poster []byte, img image.Image) error {
+	err := app.storage.Put(prefix+"/original", bytes.NewReader(poster))
+	if err != nil {
+		return err
+	}
+
+	for size, width := range data.PosterWidths {
+		thumb := thumbnail.Resize(img, width)
+
+		// JPEG has no transparency, so transparent parts of the image are drawn on
+		// a white background rather than coming out black.
+		flat := image.NewRGBA(thumb.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), thumb, thumb.Bounds().Min, draw.Over)
+
+		var buf bytes.Buffer
+
+		err = jpeg.Encode(&buf, flat, &jpeg.Options{Quality: 85})
+		if err != nil {
+			return err
+		}
+
+		err = app.storage.Put(prefix+"/"+size+".jpg", &buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deletePoster removes the files of a poster. It is only called to clean up, so errors
+// are logged rather than returned.
+func (app *application) deletePoster(r *http.Request, prefix string) {
+	err := app.storage.Delete(prefix)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+func (app *application) showPosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	size := app.readString(qs, "size", "original")
+	version := app.readString(qs, "v", "")
+
+	v := validator.New()
+
+	if v.Check(validator.In(size, data.PosterSizes...), "size", "must be small, medium, large or original"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The v parameter of the poster URLs is the ID of the poster, so a URL for a
+	// poster which has since been replaced no longer works.
+	if movie.PosterID == "" || (version != "" && version != movie.PosterID) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%s-%s"`, movie.PosterID, size)
+
+	// A poster never changes once uploaded, so the URLs which name the poster can be
+	// cached for good. Without the poster ID the URL shows whichever poster is
+	// current, so it is only cached for a short while.
+	cacheControl := "public, max-age=31536000, immutable"
+	if version == "" {
+		cacheControl = "public, max-age=300"
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && app.etagMatches(ifNoneMatch, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	key := posterPrefix(id, movie.PosterID) + "/original"
+	if size != "original" {
+		key = posterPrefix(id, movie.PosterID) + "/" + size + ".jpg"
+	}
+
+	file, err := app.storage.Get(key)
+	if err != nil {
+		w.Header().Del("ETag")
+		w.Header().Del("Cache-Control")
+
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	// The type of the original is sniffed again, as it was stored as it was uploaded.
+	body := bufio.NewReader(file)
+	head, _ := body.Peek(512)
+
+	w.Header().Set("Content-Type", http.DetectContentType(head))
+
+	_, err = io.Copy(w, body)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// moviePostersPrefix returns the storage key prefix of the files of all the posters of
+// a movie.
+func moviePostersPrefix(movieID int64) string {
+	return fmt.Sprintf("posters/%d", movieID)
+}
+
+// posterPrefix returns the storage key prefix of the files of a poster.
+func posterPrefix(movieID int64, posterID string) string {
+	return moviePostersPrefix(movieID) + "/" + posterID
+}
+
+func generatePosterID() (string, error) {
+	randomBytes := make([]byte, 8)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(randomBytes), nil
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/manunio/greenlight/internal/data"
 	"net/http"
+	"strings"
 )
 
 func (app *application) routes() http.Handler {
@@ -19,16 +20,137 @@ func (app *application) routes() http.Handler {
 	// /v1/movies
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission(data.MoviesRead, app.listMoviesHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission(data.MoviesWrite, app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission(data.MoviesRead, app.showMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id", app.staticOr(map[string]http.HandlerFunc{
+		"batch":  app.requirePermission(data.MoviesWrite, app.batchMoviesHandler),
+		"import": app.requirePermission(data.MoviesWrite, app.importMoviesHandler),
+	}, app.methodNotAllowed(router)))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.staticOr(map[string]http.HandlerFunc{
+		"export":  app.requirePermission(data.MoviesRead, app.exportMoviesHandler),
+		"suggest": app.requirePermission(data.MoviesRead, app.suggestMoviesHandler),
+		"trash":   app.requirePermission(data.MoviesWrite, app.listTrashHandler),
+	}, app.requirePermission(data.MoviesRead, app.showMovieHandler)))
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission(data.MoviesWrite, app.updateMovieHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission(data.MoviesWrite, app.deleteMovieHandler))
 
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/restore", app.requirePermission(data.MoviesWrite, app.restoreMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/merge", app.requirePermission(data.MoviesWrite, app.mergeMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/similar", app.requirePermission(data.MoviesRead, app.listSimilarMoviesHandler))
+
+	// /v1/movies/:id/poster. The posters are served without authentication, so that they
+	// can be used directly in web pages and cached by shared caches.
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/poster", app.showPosterHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/poster", app.requirePermission(data.MoviesWrite, app.uploadPosterHandler))
+
+	// /v1/movies/:id/versions
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/versions", app.requirePermission(data.MoviesRead, app.listMovieVersionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/versions/:version", app.requirePermission(data.MoviesRead, app.showMovieVersionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/versions/:version/restore", app.requirePermission(data.MoviesWrite, app.restoreMovieVersionHandler))
+
+	// /v1/movies/:id/reviews
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews", app.requirePermission(data.MoviesRead, app.listReviewsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/reviews", app.requirePermission(data.ReviewsWrite, app.createReviewHandler))
+
+	// /v1/reviews
+	router.HandlerFunc(http.MethodGet, "/v1/reviews/:id", app.requirePermission(data.MoviesRead, app.showReviewHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/reviews/:id", app.requirePermission(data.ReviewsWrite, app.updateReviewHandler))
+	// Moderators can delete reviews without having the reviews:write permission, so the
+	// permissions are checked by the handler.
+	router.HandlerFunc(http.MethodDelete, "/v1/reviews/:id", app.requireActivatedUser(app.deleteReviewHandler))
+
+	// /v1/movies/:id/credits
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/credits", app.requirePermission(data.MoviesRead, app.listMovieCreditsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/credits", app.requirePermission(data.MoviesWrite, app.createMovieCreditHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/credits/:id", app.requirePermission(data.MoviesWrite, app.deleteCreditHandler))
+
+	// /v1/movies/:id/releases
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/releases", app.requirePermission(data.MoviesRead, app.listMovieReleasesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/releases", app.requirePermission(data.MoviesWrite, app.updateMovieReleasesHandler))
+
+	// /v1/stats
+	router.HandlerFunc(http.MethodGet, "/v1/stats/movies", app.requirePermission(data.MoviesRead, app.showMovieStatsHandler))
+
+	// /v1/people
+	router.HandlerFunc(http.MethodGet, "/v1/people", app.requirePermission(data.MoviesRead, app.listPeopleHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/people", app.requirePermission(data.MoviesWrite, app.createPersonHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/people/:id", app.requirePermission(data.MoviesRead, app.showPersonHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/people/:id", app.requirePermission(data.MoviesWrite, app.updatePersonHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/people/:id", app.requirePermission(data.MoviesWrite, app.deletePersonHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/people/:id/filmography", app.requirePermission(data.MoviesRead, app.showFilmographyHandler))
+
+	// /v1/genres
+	router.HandlerFunc(http.MethodGet, "/v1/genres", app.requirePermission(data.MoviesRead, app.listGenresHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/genres", app.requirePermission(data.GenresWrite, app.createGenreHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/genres/:id", app.requirePermission(data.MoviesRead, app.showGenreHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/genres/:id/merge", app.requirePermission(data.GenresWrite, app.mergeGenreHandler))
+
 	// /v1/users
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 
+	// /v1/users/me/lists
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/lists", app.requirePermission(data.MoviesRead, app.listUserListsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/lists", app.requirePermission(data.MoviesRead, app.createUserListHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/lists/:id", app.requirePermission(data.MoviesRead, app.showUserListHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/lists/:id", app.requirePermission(data.MoviesRead, app.updateUserListHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/lists/:id", app.requirePermission(data.MoviesRead, app.deleteUserListHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/lists/:id/movies", app.requirePermission(data.MoviesRead, app.addListEntryHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/lists/:id/movies", app.requirePermission(data.MoviesRead, app.reorderListEntriesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/lists/:id/movies/:movie_id", app.requirePermission(data.MoviesRead, app.removeListEntryHandler))
+
+	// /v1/lists is the read-only view of public lists, which doesn't need an account.
+	router.HandlerFunc(http.MethodGet, "/v1/lists/:token", app.showSharedListHandler)
+
 	// /v1/tokens
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 
 	return app.recoverPanic(app.rateLimit(app.authenticate(router)))
 }
+
+// staticOr is used for routes in the form /v1/movies/:id. httprouter doesn't allow a
+// static path segment like /v1/movies/suggest next to the :id parameter for the same
+// method, so the static routes are registered through this handler instead: if the
+// :id segment matches one of the names in static, the request is passed to that
+// handler, otherwise it goes to next.
+func (app *application) staticOr(static map[string]http.HandlerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+
+		if handler, ok := static[params.ByName("id")]; ok {
+			handler(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// methodNotAllowed returns the handler for the requests to a path which only static
+// routes (see staticOr()) exist for with the request's method, like a POST to
+// /v1/movies/:id for any ID other than "batch" or "import". It sends the same 405
+// Method Not Allowed response as the router does, listing the methods the path does
+// have routes for in the Allow header.
+func (app *application) methodNotAllowed(router *httprouter.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			if method == r.Method {
+				continue
+			}
+
+			if handle, _, _ := router.Lookup(method, r.URL.Path); handle != nil {
+				allowed = append(allowed, method)
+			}
+		}
+
+		if len(allowed) > 0 {
+			if router.HandleOPTIONS {
+				allowed = append(allowed, http.MethodOptions)
+			}
+
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+		}
+
+		app.methodNotAllowedResponse(w, r)
+	}
+}
@@ -19,6 +19,9 @@ func (app *application) serve() error {
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		// Keep the connection of each request in its context, so that the handlers
+		// which need longer than the timeouts above can extend them.
+		ConnContext: app.contextSetConn,
 		// Create a new Go log.logger with the log.New() function, passing in
 		// our custom logger as the first parameter. The "" and 0 indicate that the
 		// log.Logger instance should not use a prefix or any flags.
@@ -27,6 +30,10 @@ func (app *application) serve() error {
 
 	shutdownError := make(chan error)
 
+	// The stop channel is closed during the graceful shutdown, to tell the scheduled
+	// background jobs to return.
+	stop := make(chan struct{})
+
 	// start a background goroutine.
 	go func() {
 		// Create a quit channel which carries os.Signal values.
@@ -45,6 +52,8 @@ func (app *application) serve() error {
 			"signal": s.String(),
 		})
 
+		close(stop)
+
 		// Create a context with a 5-second timeout.
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -77,6 +86,16 @@ func (app *application) serve() error {
 
 	}()
 
+	// Start purging expired movies from the trash in the background.
+	app.background(func() {
+		app.purgeTrash(stop)
+	})
+
+	// Keep the catalog statistics up to date in the background.
+	app.background(func() {
+		app.refreshMovieStats(stop)
+	})
+
 	app.logger.PrintInfo("starting server", map[string]string{
 		"addr": srv.Addr,
 		"env":  app.config.env,
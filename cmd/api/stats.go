@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// showMovieStatsHandler sends the catalog statistics. They are recomputed every stats
+// refresh interval rather than on each request, so they may lag behind the latest
+// changes by up to that long; refreshed_at says when they were computed.
+func (app *application) showMovieStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.models.Movies.GetStats()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"stats": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshMovieStats recomputes the catalog statistics straight away, so that they
+// don't stay as old as the last run of the application, and then once every stats
+// refresh interval until the stop channel is closed. It should be run in the
+// background.
+func (app *application) refreshMovieStats(stop <-chan struct{}) {
+	if app.config.stats.refreshInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(app.config.stats.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		err := app.models.Movies.RefreshStats()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
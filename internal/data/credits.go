@@ -0,0 +1,208 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/manunio/greenlight/internal/validator"
+	"time"
+)
+
+// CreditRoles holds the roles a person can be credited with on a movie.
+var CreditRoles = []string{"actor", "director", "writer"}
+
+// Credit links a person to a movie they worked on. When listing the credits of a movie
+// the person's name is filled in, and when listing a person's filmography the movie's
+// title and year are.
+type Credit struct {
+	ID           int64  `json:"id"`
+	MovieID      int64  `json:"movie_id"`
+	PersonID     int64  `json:"person_id"`
+	Role         string `json:"role"`
+	Character    string `json:"character,omitempty"`
+	BillingOrder int32  `json:"billing_order"`
+	PersonName   string `json:"person_name,omitempty"`
+	MovieTitle   string `json:"movie_title,omitempty"`
+	MovieYear    int32  `json:"movie_year,omitempty"`
+}
+
+func ValidateCredit(v *validator.Validator, credit *Credit) {
+	v.Check(credit.PersonID > 0, "person_id", "must be provided")
+
+	v.Check(credit.Role != "", "role", "must be provided")
+	v.Check(validator.In(credit.Role, CreditRoles...), "role", "must be actor, director or writer")
+
+	// Only actors play characters.
+	v.Check(credit.Character == "" || credit.Role == "actor", "character", "can only be given for actors")
+	v.Check(len(credit.Character) <= 500, "character", "must not be more than 500 bytes long")
+
+	v.Check(credit.BillingOrder >= 0, "billing_order", "must not be negative")
+}
+
+type CreditModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a new credit. It returns ErrRecordNotFound if either the movie or the
+// person doesn't exist (or the movie is in the trash).
+func (m CreditModel) Insert(credit *Credit) error {
+	query := `
+		INSERT INTO credits (movie_id, person_id, role, character, billing_order)
+		SELECT $1, $2, $3, $4, $5
+		WHERE EXISTS (SELECT 1 FROM movies WHERE id = $1 AND deleted_at IS NULL)
+		AND EXISTS (SELECT 1 FROM people WHERE id = $2)
+		RETURNING id`
+
+	args := []interface{}{credit.MovieID, credit.PersonID, credit.Role, credit.Character, credit.BillingOrder}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&credit.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAllForMovie returns the credits of a movie, with the directors first, then the
+// writers and then the actors, each in billing order.
+func (m CreditModel) GetAllForMovie(movieID int64) (credits []*Credit, err error) {
+	query := `
+		SELECT credits.id, credits.movie_id, credits.person_id, credits.role, credits.character, credits.billing_order, people.name
+		FROM credits
+		INNER JOIN people ON people.id = credits.person_id
+		WHERE credits.movie_id = $1
+		ORDER BY array_position(ARRAY['director', 'writer', 'actor'], credits.role), credits.billing_order, credits.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	credits = []*Credit{}
+
+	for rows.Next() {
+		var credit Credit
+
+		err := rows.Scan(
+			&credit.ID,
+			&credit.MovieID,
+			&credit.PersonID,
+			&credit.Role,
+			&credit.Character,
+			&credit.BillingOrder,
+			&credit.PersonName,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		credits = append(credits, &credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credits, nil
+}
+
+// GetAllForPerson returns the filmography of a person: their credits on the movies
+// which aren't in the trash, newest movie first.
+func (m CreditModel) GetAllForPerson(personID int64) (credits []*Credit, err error) {
+	query := `
+		SELECT credits.id, credits.movie_id, credits.person_id, credits.role, credits.character, credits.billing_order, movies.title, movies.year
+		FROM credits
+		INNER JOIN movies ON movies.id = credits.movie_id
+		WHERE credits.person_id = $1 AND movies.deleted_at IS NULL
+		ORDER BY movies.year DESC, movies.title, movies.id, credits.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, personID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	credits = []*Credit{}
+
+	for rows.Next() {
+		var credit Credit
+
+		err := rows.Scan(
+			&credit.ID,
+			&credit.MovieID,
+			&credit.PersonID,
+			&credit.Role,
+			&credit.Character,
+			&credit.BillingOrder,
+			&credit.MovieTitle,
+			&credit.MovieYear,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		credits = append(credits, &credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credits, nil
+}
+
+func (m CreditModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM credits
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
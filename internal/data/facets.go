@@ -0,0 +1,166 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"github.com/manunio/greenlight/internal/validator"
+	"strings"
+	"time"
+)
+
+// FacetSafelist holds the names of the facets which can be requested for the movie
+// listing.
+var FacetSafelist = []string{"genres", "year", "decade", "runtime"}
+
+// runtimeBucketSize is the width (in minutes) of the runtime facet buckets. Movies of
+// maxRuntimeBucket minutes or longer are all counted in the last bucket.
+const (
+	runtimeBucketSize = 30
+	maxRuntimeBucket  = 180
+)
+
+// FacetCount is the number of movies which have a given value for a facet.
+type FacetCount struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+}
+
+// Facets holds the counts for each requested facet, keyed by the facet name.
+type Facets map[string][]FacetCount
+
+func ValidateFacets(v *validator.Validator, facets []string) {
+	for _, facet := range facets {
+		if !validator.In(facet, FacetSafelist...) {
+			v.AddError("facets", "invalid facet value")
+			return
+		}
+	}
+
+	v.Check(validator.Unique(facets), "facets", "must not contain duplicate values")
+}
+
+// GetFacets counts the movies matching the search for every value of each of the named
+// facets. This is done with a single GROUP BY query per facet.
+func (m MovieModel) GetFacets(search MovieSearch, names []string) (Facets, error) {
+	facets := Facets{}
+
+	for _, name := range names {
+		counts, err := m.getFacet(search, name)
+		if err != nil {
+			return nil, err
+		}
+
+		facets[name] = counts
+	}
+
+	return facets, nil
+}
+
+func (m MovieModel) getFacet(search MovieSearch, name string) (counts []FacetCount, err error) {
+	conditions, args := search.conditions()
+
+	// The genres facet is counted over the unnested genres array, so that a movie is
+	// counted once for each of its genres. Decades and runtime buckets are calculated
+	// with integer division.
+	var query string
+
+	switch name {
+	case "genres":
+		query = `
+			SELECT genre, count(*)
+			FROM movies, unnest(genres) AS genre
+			WHERE %s
+			GROUP BY genre
+			ORDER BY count(*) DESC, genre`
+	case "year":
+		query = `
+			SELECT year, count(*)
+			FROM movies
+			WHERE %s
+			GROUP BY year
+			ORDER BY year`
+	case "decade":
+		query = `
+			SELECT year / 10 * 10 AS decade, count(*)
+			FROM movies
+			WHERE %s
+			GROUP BY decade
+			ORDER BY decade`
+	case "runtime":
+		query = fmt.Sprintf(`
+			SELECT least(runtime / %[1]d * %[1]d, %[2]d) AS bucket, count(*)
+			FROM movies
+			WHERE %%s
+			GROUP BY bucket
+			ORDER BY bucket`, runtimeBucketSize, maxRuntimeBucket)
+	default:
+		panic("unknown facet: " + name)
+	}
+
+	query = fmt.Sprintf(query, strings.Join(conditions, "\n\t\t\tAND "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	counts = []FacetCount{}
+
+	for rows.Next() {
+		var count FacetCount
+
+		if name == "genres" {
+			var genre string
+
+			err := rows.Scan(&genre, &count.Count)
+			if err != nil {
+				return nil, err
+			}
+
+			count.Value = genre
+		} else {
+			var value int
+
+			err := rows.Scan(&value, &count.Count)
+			if err != nil {
+				return nil, err
+			}
+
+			count.Value = facetLabel(name, value)
+		}
+
+		counts = append(counts, count)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// facetLabel returns the value to show to clients for a numeric facet value, like
+// "1990s" for a decade or "90-119 mins" for a runtime bucket.
+func facetLabel(name string, value int) interface{} {
+	switch name {
+	case "decade":
+		return fmt.Sprintf("%ds", value)
+	case "runtime":
+		if value >= maxRuntimeBucket {
+			return fmt.Sprintf("%d+ mins", value)
+		}
+		return fmt.Sprintf("%d-%d mins", value, value+runtimeBucketSize-1)
+	default:
+		return value
+	}
+}
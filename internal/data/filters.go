@@ -1,17 +1,26 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/manunio/greenlight/internal/validator"
 	"math"
 	"strings"
 )
 
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
+	Facets       Facets `json:"facets,omitempty"`
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -33,40 +42,291 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	// Cursor holds the opaque value taken from a previous response's next_cursor or
+	// prev_cursor. When it is set the results are paged using the sort key values
+	// stored in the cursor (keyset pagination) instead of Page.
+	Cursor string
+	// Fields restricts the response to the listed fields, each of which must be in
+	// FieldSafelist. An empty Fields means all fields are returned.
+	Fields        []string
+	FieldSafelist []string
+}
+
+// sortFields splits the Sort value into its comma-separated fields, so that the
+// results can be ordered by several columns like "-year,title".
+func (f Filters) sortFields() []string {
+	return strings.Split(f.Sort, ",")
 }
 
-func (f Filters) sortColumn() string {
+func (f Filters) sortColumn(field string) string {
 	for _, safeValue := range f.SortSafelist {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+		if field == safeValue {
+			return strings.TrimPrefix(field, "-")
 		}
 	}
 
-	panic("unsafe sort parameter: " + f.Sort)
+	panic("unsafe sort parameter: " + field)
 }
 
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
+func (f Filters) sortDirection(field string) string {
+	if strings.HasPrefix(field, "-") {
 		return "DESC"
 	}
 
 	return "ASC"
 }
 
+// SortsBy reports whether the given column is one of the sort fields, in either
+// direction.
+func (f Filters) SortsBy(column string) bool {
+	for _, field := range f.sortFields() {
+		if strings.TrimPrefix(field, "-") == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortKey is a single column of the ORDER BY clause. If sql is set, it holds the
+// expression that is used in place of the column when the value isn't stored in the
+// table (like a computed relevance score).
+type sortKey struct {
+	column string
+	desc   bool
+	sql    string
+}
+
+func (k sortKey) expression() string {
+	if k.sql != "" {
+		return k.sql
+	}
+
+	return k.column
+}
+
+// sortKeys returns the columns the results are ordered by, in the order they were
+// given in Sort. Unless the client already sorts by id, the id column is added as the
+// last key so that the ordering is deterministic, which keyset pagination relies on.
+func (f Filters) sortKeys() []sortKey {
+	var keys []sortKey
+	sortsByID := false
+
+	for _, field := range f.sortFields() {
+		column := f.sortColumn(field)
+		if column == "id" {
+			sortsByID = true
+		}
+
+		keys = append(keys, sortKey{column: column, desc: f.sortDirection(field) == "DESC"})
+	}
+
+	if !sortsByID {
+		keys = append(keys, sortKey{column: "id"})
+	}
+
+	return keys
+}
+
 func (f Filters) limit() int {
+	// In cursor mode we fetch one extra row, which tells us whether there is another
+	// page after this one without having to count the remaining records.
+	if f.Cursor != "" {
+		return f.PageSize + 1
+	}
+
 	return f.PageSize
 }
 
 func (f Filters) offset() int {
+	if f.Cursor != "" {
+		return 0
+	}
+
 	return (f.Page - 1) * f.PageSize
 }
 
+// orderBy returns the body of an ORDER BY clause for the given keys. If reverse is
+// true every direction is flipped, which is used when paging backwards from a cursor.
+func orderBy(keys []sortKey, reverse bool) string {
+	clauses := make([]string, len(keys))
+
+	for i, key := range keys {
+		direction := "ASC"
+		if key.desc != reverse {
+			direction = "DESC"
+		}
+
+		clauses[i] = fmt.Sprintf("%s %s", key.expression(), direction)
+	}
+
+	return strings.Join(clauses, ", ")
+}
+
+// keysetCondition returns a WHERE condition matching the rows which come after the
+// row the cursor points at (or before it, for a backward cursor), together with args
+// extended by the cursor values. Because the keys may mix ASC and DESC directions we
+// can't use a row value comparison, so the condition is expanded to the form
+// (a > $1) OR (a = $1 AND b > $2) OR ...
+func keysetCondition(keys []sortKey, c *cursor, args []interface{}) (string, []interface{}) {
+	placeholders := make([]string, len(keys))
+
+	for i := range keys {
+		args = append(args, c.Values[i])
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+
+	alternatives := make([]string, len(keys))
+
+	for i, key := range keys {
+		operator := ">"
+		if key.desc != c.Backward {
+			operator = "<"
+		}
+
+		terms := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			terms = append(terms, fmt.Sprintf("%s = %s", keys[j].expression(), placeholders[j]))
+		}
+		terms = append(terms, fmt.Sprintf("%s %s %s", key.expression(), operator, placeholders[i]))
+
+		alternatives[i] = "(" + strings.Join(terms, " AND ") + ")"
+	}
+
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+// cursor is the decoded form of the opaque cursor strings handed out in Metadata. It
+// records the sort it was issued for, the sort key values of the row it points at and
+// whether the client is paging backwards from that row.
+type cursor struct {
+	Sort     string        `json:"s"`
+	Values   []interface{} `json:"v"`
+	Backward bool          `json:"b,omitempty"`
+}
+
+func encodeCursor(c cursor) (string, error) {
+	js, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(js), nil
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	// Use UseNumber() so that integer sort values don't lose precision by being
+	// decoded into a float64.
+	dec := json.NewDecoder(strings.NewReader(string(js)))
+	dec.UseNumber()
+
+	var c cursor
+
+	err = dec.Decode(&c)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	// Only allow scalar values, which we pass on to the database as query arguments.
+	for i, value := range c.Values {
+		switch value := value.(type) {
+		case json.Number:
+			c.Values[i] = value.String()
+		case string:
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	return &c, nil
+}
+
+// setCursors populates the NextCursor and PrevCursor fields of the metadata. The first
+// and last arguments are the sort key values of the first and last rows of the
+// current page.
+func (f Filters) setCursors(metadata *Metadata, hasNext, hasPrev bool, first, last []interface{}) error {
+	var err error
+
+	if hasNext && last != nil {
+		metadata.NextCursor, err = encodeCursor(cursor{Sort: f.Sort, Values: last})
+		if err != nil {
+			return err
+		}
+	}
+
+	if hasPrev && first != nil {
+		metadata.PrevCursor, err = encodeCursor(cursor{Sort: f.Sort, Values: first, Backward: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 10_00_000, "page", "must be greater than zero")
 	v.Check(f.Page <= 10_00_000, "page", "must be a maximum of 10 million")
-	v.Check(f.Page > 0, "page_size", "must be greater than zero")
-	v.Check(f.Page > 0, "page_size", "must be a maximum of 100")
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+
+	ValidateSort(v, f)
+
+	ValidateFields(v, f.Fields, f.FieldSafelist)
+
+	// The cursor can only be checked against a valid sort value.
+	_, sortInvalid := v.Errors["sort"]
+
+	if f.Cursor != "" && !sortInvalid {
+		c, err := decodeCursor(f.Cursor)
+		if err != nil {
+			v.AddError("cursor", "invalid cursor value")
+			return
+		}
+
+		v.Check(c.Sort == f.Sort, "cursor", "does not match the sort value")
+		v.Check(len(c.Values) == len(f.sortKeys()), "cursor", "invalid cursor value")
+	}
+}
+
+// ValidateSort checks the sort value of the filters on its own, for listings which
+// aren't paginated.
+func ValidateSort(v *validator.Validator, f Filters) {
+	// Check every field of the sort value against the safelist, and make sure that no
+	// column is used more than once (e.g. "year,-year").
+	sortValid := true
+	columns := []string{}
+
+	for _, field := range f.sortFields() {
+		if !validator.In(field, f.SortSafelist...) {
+			sortValid = false
+			break
+		}
+
+		columns = append(columns, strings.TrimPrefix(field, "-"))
+	}
+
+	v.Check(sortValid, "sort", "invalid sort value")
+
+	if sortValid {
+		v.Check(validator.Unique(columns), "sort", "must not contain duplicate columns")
+	}
+}
+
+// ValidateFields checks that all the requested fields are in the safelist, in the same
+// way as the sort value is checked.
+func ValidateFields(v *validator.Validator, fields []string, safelist []string) {
+	for _, field := range fields {
+		if !validator.In(field, safelist...) {
+			v.AddError("fields", "invalid fields value")
+			return
+		}
+	}
 
-	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	v.Check(validator.Unique(fields), "fields", "must not contain duplicate values")
 }
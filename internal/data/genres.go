@@ -0,0 +1,414 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/manunio/greenlight/internal/validator"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	// ErrDuplicateGenre is returned when the slug or one of the aliases of a genre is
+	// already used by another genre.
+	ErrDuplicateGenre = errors.New("duplicate genre")
+	// ErrSameGenre is returned when a genre is merged into itself.
+	ErrSameGenre = errors.New("same genre")
+)
+
+// Genre is a canonical genre of the taxonomy. The genres of movies are stored as the
+// slugs of their canonical genres.
+type Genre struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	// Aliases are the other names the genre is known by, in slug form. Movie writes
+	// using any of them are normalized to the genre.
+	Aliases []string `json:"aliases"`
+	Version int32    `json:"version"`
+}
+
+// Slugify returns the slug form of a genre name: lower case, with each run of
+// characters other than letters and digits replaced by a single hyphen.
+func Slugify(name string) string {
+	var b strings.Builder
+
+	hyphen := false
+
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(r)
+			continue
+		}
+
+		hyphen = true
+	}
+
+	return b.String()
+}
+
+func ValidateGenre(v *validator.Validator, genre *Genre) {
+	v.Check(genre.Name != "", "name", "must be provided")
+	v.Check(len(genre.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(genre.Slug != "", "slug", "must be provided")
+	v.Check(len(genre.Slug) <= 100, "slug", "must not be more than 100 bytes long")
+	v.Check(Slugify(genre.Slug) == genre.Slug, "slug", "must only contain lower case letters, digits and single hyphens")
+
+	v.Check(len(genre.Aliases) <= 20, "aliases", "must not contain more than 20 aliases")
+
+	for _, alias := range genre.Aliases {
+		v.Check(Slugify(alias) != "", "aliases", "must not contain empty aliases")
+		v.Check(len(alias) <= 100, "aliases", "must not contain aliases more than 100 bytes long")
+	}
+}
+
+type GenreModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a new genre along with its aliases. The slug and the name of the genre
+// are made aliases too, and the aliases are stored in slug form. It returns
+// ErrDuplicateGenre if any of them is already used by another genre.
+func (m GenreModel) Insert(genre *Genre) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, nil, func(tx *sql.Tx) error {
+		query := `
+			INSERT INTO genres (slug, name)
+			VALUES ($1, $2)
+			RETURNING id, created_at, version`
+
+		err := tx.QueryRowContext(ctx, query, genre.Slug, genre.Name).Scan(&genre.ID, &genre.CreatedAt, &genre.Version)
+		if err != nil {
+			switch {
+			case err.Error() == `pq: duplicate key value violates unique constraint "genres_slug_key"`:
+				return ErrDuplicateGenre
+			default:
+				return err
+			}
+		}
+
+		aliases := []string{genre.Slug, Slugify(genre.Name)}
+		for _, alias := range genre.Aliases {
+			aliases = append(aliases, Slugify(alias))
+		}
+
+		query = `
+			INSERT INTO genre_aliases (alias, genre_id)
+			SELECT DISTINCT alias, $2
+			FROM unnest($1::text[]) AS alias
+			WHERE alias <> ''`
+
+		_, err = tx.ExecContext(ctx, query, pq.Array(aliases), genre.ID)
+		if err != nil {
+			switch {
+			case err.Error() == `pq: duplicate key value violates unique constraint "genre_aliases_pkey"`:
+				return ErrDuplicateGenre
+			default:
+				return err
+			}
+		}
+
+		genre.Aliases = genreAliases(genre.Slug, aliases)
+
+		return nil
+	})
+}
+
+func (m GenreModel) Get(id int64) (*Genre, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT genres.id, genres.created_at, genres.slug, genres.name, array_remove(array_agg(genre_aliases.alias ORDER BY genre_aliases.alias), NULL), genres.version
+		FROM genres
+		LEFT JOIN genre_aliases ON genre_aliases.genre_id = genres.id
+		WHERE genres.id = $1
+		GROUP BY genres.id`
+
+	var genre Genre
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(genreScanDest(&genre)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	genre.Aliases = genreAliases(genre.Slug, genre.Aliases)
+
+	return &genre, nil
+}
+
+// GetAll returns the whole taxonomy, sorted by name.
+func (m GenreModel) GetAll() (genres []*Genre, err error) {
+	query := `
+		SELECT genres.id, genres.created_at, genres.slug, genres.name, array_remove(array_agg(genre_aliases.alias ORDER BY genre_aliases.alias), NULL), genres.version
+		FROM genres
+		LEFT JOIN genre_aliases ON genre_aliases.genre_id = genres.id
+		GROUP BY genres.id
+		ORDER BY genres.name, genres.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	genres = []*Genre{}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(genreScanDest(&genre)...)
+		if err != nil {
+			return nil, err
+		}
+
+		genre.Aliases = genreAliases(genre.Slug, genre.Aliases)
+
+		genres = append(genres, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
+
+// Merge folds the source genre into the target genre: the slug and aliases of the
+// source become aliases of the target, the movies using the source are changed to use
+// the target instead (recording a new version of each of them, edited by userID), and
+// the source genre is deleted. It returns the target genre as it is after the merge.
+func (m GenreModel) Merge(sourceID, targetID, userID int64) (*Genre, error) {
+	if sourceID < 1 || targetID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	if sourceID == targetID {
+		return nil, ErrSameGenre
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := withTx(ctx, m.DB, nil, func(tx *sql.Tx) error {
+		query := `
+			SELECT id, slug
+			FROM genres
+			WHERE id IN ($1, $2)
+			ORDER BY id
+			FOR UPDATE`
+
+		rows, err := tx.QueryContext(ctx, query, sourceID, targetID)
+		if err != nil {
+			return err
+		}
+
+		slugs := make(map[int64]string, 2)
+
+		for rows.Next() {
+			var id int64
+			var slug string
+
+			err := rows.Scan(&id, &slug)
+			if err != nil {
+				_ = rows.Close()
+				return err
+			}
+
+			slugs[id] = slug
+		}
+
+		if err = rows.Err(); err != nil {
+			_ = rows.Close()
+			return err
+		}
+
+		if err = rows.Close(); err != nil {
+			return err
+		}
+
+		if len(slugs) != 2 {
+			return ErrRecordNotFound
+		}
+
+		query = `
+			UPDATE genre_aliases
+			SET genre_id = $1
+			WHERE genre_id = $2`
+
+		_, err = tx.ExecContext(ctx, query, targetID, sourceID)
+		if err != nil {
+			return err
+		}
+
+		// The source genre is replaced by the target in place, or just removed if the
+		// movie already has the target genre. Movies in the trash are updated too, so
+		// that they can still be restored.
+		query = `
+			WITH merged AS (
+				UPDATE movies
+				SET genres = CASE
+						WHEN genres @> ARRAY[$2::text] THEN array_remove(genres, $1::text)
+						ELSE array_replace(genres, $1::text, $2::text)
+					END,
+					version = version + 1
+				WHERE genres @> ARRAY[$1::text]
+				RETURNING id, version, title, year, runtime, genres
+			)
+			INSERT INTO movies_history (movie_id, version, title, year, runtime, genres, edited_by)
+			SELECT id, version, title, year, runtime, genres, $3
+			FROM merged`
+
+		// Record the anonymous user (who has no ID) as NULL.
+		editedBy := sql.NullInt64{Int64: userID, Valid: userID > 0}
+
+		_, err = tx.ExecContext(ctx, query, slugs[sourceID], slugs[targetID], editedBy)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			DELETE FROM genres
+			WHERE id = $1`
+
+		_, err = tx.ExecContext(ctx, query, sourceID)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			UPDATE genres
+			SET version = version + 1
+			WHERE id = $1`
+
+		_, err = tx.ExecContext(ctx, query, targetID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Get(targetID)
+}
+
+// Normalize maps each of the genre names to the slug of the canonical genre it is an
+// alias of. Names which aren't aliases of any genre are returned in unknown, and are
+// left in genres in slug form. A nil slice is returned unchanged, so that a missing
+// genres field is still reported by ValidateMovie.
+func (m GenreModel) Normalize(names []string) (genres []string, unknown []string, err error) {
+	if names == nil {
+		return nil, nil, nil
+	}
+
+	aliases := make([]string, len(names))
+	for i, name := range names {
+		aliases[i] = Slugify(name)
+	}
+
+	query := `
+		SELECT genre_aliases.alias, genres.slug
+		FROM genre_aliases
+		INNER JOIN genres ON genres.id = genre_aliases.genre_id
+		WHERE genre_aliases.alias = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(aliases))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer func() {
+		if closeErr := rows.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	slugs := make(map[string]string, len(aliases))
+
+	for rows.Next() {
+		var alias, slug string
+
+		err := rows.Scan(&alias, &slug)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		slugs[alias] = slug
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	genres = make([]string, len(names))
+
+	for i, alias := range aliases {
+		slug, ok := slugs[alias]
+		if !ok {
+			unknown = append(unknown, names[i])
+			slug = alias
+		}
+
+		genres[i] = slug
+	}
+
+	return genres, unknown, nil
+}
+
+// genreAliases returns the aliases of a genre other than its own slug, which is always
+// an alias and so isn't worth listing.
+func genreAliases(slug string, aliases []string) []string {
+	seen := map[string]bool{slug: true}
+	others := []string{}
+
+	for _, alias := range aliases {
+		if alias != "" && !seen[alias] {
+			seen[alias] = true
+			others = append(others, alias)
+		}
+	}
+
+	return others
+}
+
+func genreScanDest(genre *Genre) []interface{} {
+	return []interface{}{
+		&genre.ID,
+		&genre.CreatedAt,
+		&genre.Slug,
+		&genre.Name,
+		pq.Array(&genre.Aliases),
+		&genre.Version,
+	}
+}
@@ -0,0 +1,567 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/manunio/greenlight/internal/validator"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDuplicateListEntry = errors.New("duplicate list entry")
+	ErrInvalidListOrder   = errors.New("invalid list order")
+)
+
+// MovieList is an ordered list of movies kept by a user. Every user has a watchlist,
+// which is created the first time it is needed and can't be renamed or deleted, and
+// can have any number of other lists. Public lists can be viewed by anyone through
+// their share URL.
+type MovieList struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	UserID     int64     `json:"-"`
+	Name       string    `json:"name"`
+	Watchlist  bool      `json:"watchlist"`
+	Public     bool      `json:"public"`
+	ShareToken string    `json:"-"`
+	Version    int32     `json:"version"`
+}
+
+// ShareURL returns the path of the read-only view of the list. It only works while the
+// list is public.
+func (list MovieList) ShareURL() string {
+	return "/v1/lists/" + list.ShareToken
+}
+
+// MarshalJSON adds the share URL to the JSON representation of the list.
+func (list MovieList) MarshalJSON() ([]byte, error) {
+	// The alias type has the same fields but not this method, so that encoding it
+	// doesn't recurse.
+	type alias MovieList
+
+	return json.Marshal(struct {
+		alias
+		ShareURL string `json:"share_url"`
+	}{alias(list), list.ShareURL()})
+}
+
+// ListEntry is a movie in a list, at the given position (starting at 1).
+type ListEntry struct {
+	Position int32     `json:"position"`
+	AddedAt  time.Time `json:"added_at"`
+	Movie    *Movie    `json:"movie"`
+}
+
+func ValidateMovieList(v *validator.Validator, list *MovieList) {
+	v.Check(list.Name != "", "name", "must be provided")
+	v.Check(len(list.Name) <= 200, "name", "must not be more than 200 bytes long")
+}
+
+type MovieListModel struct {
+	DB *sql.DB
+}
+
+// generateShareToken returns a random token for the share URL of a list, in the same
+// format as the other tokens.
+func generateShareToken() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+func (m MovieListModel) Insert(list *MovieList) error {
+	token, err := generateShareToken()
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO lists (user_id, name, public, share_token)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, list.UserID, list.Name, list.Public, token).Scan(&list.ID, &list.CreatedAt, &list.Version)
+	if err != nil {
+		return err
+	}
+
+	list.ShareToken = token
+
+	return nil
+}
+
+// ensureWatchlist creates the user's watchlist, unless they already have one.
+func (m MovieListModel) ensureWatchlist(ctx context.Context, userID int64) error {
+	token, err := generateShareToken()
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO lists (user_id, name, watchlist, share_token)
+		VALUES ($1, 'Watchlist', true, $2)
+		ON CONFLICT (user_id) WHERE watchlist DO NOTHING`
+
+	_, err = m.DB.ExecContext(ctx, query, userID, token)
+	return err
+}
+
+// GetWatchlist returns the user's watchlist, creating it if needed.
+func (m MovieListModel) GetWatchlist(userID int64) (*MovieList, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.ensureWatchlist(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, created_at, user_id, name, watchlist, public, share_token, version
+		FROM lists
+		WHERE user_id = $1 AND watchlist`
+
+	return m.getList(ctx, query, userID)
+}
+
+// GetForUser returns the list with the given ID if it belongs to the user, and
+// ErrRecordNotFound otherwise.
+func (m MovieListModel) GetForUser(id int64, userID int64) (*MovieList, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, user_id, name, watchlist, public, share_token, version
+		FROM lists
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.getList(ctx, query, id, userID)
+}
+
+// GetShared returns the list with the given share token, as long as it is public.
+func (m MovieListModel) GetShared(token string) (*MovieList, error) {
+	query := `
+		SELECT id, created_at, user_id, name, watchlist, public, share_token, version
+		FROM lists
+		WHERE share_token = $1 AND public`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.getList(ctx, query, token)
+}
+
+func (m MovieListModel) getList(ctx context.Context, query string, args ...interface{}) (*MovieList, error) {
+	var list MovieList
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(movieListScanDest(&list)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &list, nil
+}
+
+// GetAllForUser returns all of the user's lists, with the watchlist first and the
+// others in the order they were created. The watchlist is created if needed.
+func (m MovieListModel) GetAllForUser(userID int64) (lists []*MovieList, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.ensureWatchlist(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, created_at, user_id, name, watchlist, public, share_token, version
+		FROM lists
+		WHERE user_id = $1
+		ORDER BY watchlist DESC, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	lists = []*MovieList{}
+
+	for rows.Next() {
+		var list MovieList
+
+		err := rows.Scan(movieListScanDest(&list)...)
+		if err != nil {
+			return nil, err
+		}
+
+		lists = append(lists, &list)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lists, nil
+}
+
+// Update saves the name and visibility of the list. The watchlist keeps its name.
+func (m MovieListModel) Update(list *MovieList) error {
+	query := `
+		UPDATE lists
+		SET name = CASE WHEN watchlist THEN name ELSE $1 END, public = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING name, version`
+
+	args := []interface{}{list.Name, list.Public, list.ID, list.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&list.Name, &list.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the list and its entries. The watchlist can't be deleted, and
+// ErrRecordNotFound is returned for it.
+func (m MovieListModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM lists
+		WHERE id = $1 AND NOT watchlist`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetEntries returns the movies in the list, in order. Movies in the trash are left
+// out, but keep their place in the list in case they are restored.
+func (m MovieListModel) GetEntries(listID int64) (entries []*ListEntry, err error) {
+	columns := movieColumns(nil)
+
+	query := fmt.Sprintf(`
+		SELECT list_entries.position, list_entries.added_at, %s
+		FROM list_entries
+		INNER JOIN movies ON movies.id = list_entries.movie_id
+		WHERE list_entries.list_id = $1 AND movies.deleted_at IS NULL
+		ORDER BY list_entries.position`, strings.Join(columns, ", "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, listID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	entries = []*ListEntry{}
+
+	for rows.Next() {
+		entry := ListEntry{Movie: &Movie{}}
+
+		dest := append([]interface{}{&entry.Position, &entry.AddedAt}, movieScanDest(entry.Movie, columns)...)
+
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Number the visible entries from 1, as the gaps left by movies in the trash
+	// would only confuse clients.
+	for i, entry := range entries {
+		entry.Position = int32(i + 1)
+	}
+
+	return entries, nil
+}
+
+// lockList locks the list until the end of the transaction, so that changes to its
+// entries are made one at a time and the positions stay consistent.
+func lockList(ctx context.Context, tx *sql.Tx, listID int64) error {
+	_, err := tx.ExecContext(ctx, `SELECT id FROM lists WHERE id = $1 FOR UPDATE`, listID)
+	return err
+}
+
+// AddEntry adds the movie to the list at the given position, moving the movies from
+// that position on down by one. A position of 0 (or past the end of the list) adds
+// the movie at the end. It returns ErrRecordNotFound if there's no such movie, and
+// ErrDuplicateListEntry if the movie is already in the list.
+func (m MovieListModel) AddEntry(listID int64, movieID int64, position int32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, nil, func(tx *sql.Tx) error {
+		err := lockList(ctx, tx, listID)
+		if err != nil {
+			return err
+		}
+
+		// The position is one of the visible entries, so it's converted to the
+		// position stored in the table, which also counts the movies in the trash.
+		query := `
+			SELECT
+				(SELECT count(*) FROM list_entries WHERE list_id = $1),
+				coalesce((
+					SELECT list_entries.position
+					FROM list_entries
+					INNER JOIN movies ON movies.id = list_entries.movie_id
+					WHERE list_entries.list_id = $1 AND movies.deleted_at IS NULL
+					ORDER BY list_entries.position
+					OFFSET $2 - 1 LIMIT 1
+				), 0)`
+
+		var count, stored int32
+
+		if position < 1 {
+			position = 1 << 30
+		}
+
+		err = tx.QueryRowContext(ctx, query, listID, position).Scan(&count, &stored)
+		if err != nil {
+			return err
+		}
+
+		if stored == 0 {
+			stored = count + 1
+		}
+
+		query = `
+			UPDATE list_entries
+			SET position = position + 1
+			WHERE list_id = $1 AND position >= $2`
+
+		_, err = tx.ExecContext(ctx, query, listID, stored)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			INSERT INTO list_entries (list_id, movie_id, position)
+			SELECT $1, id, $3
+			FROM movies
+			WHERE id = $2 AND deleted_at IS NULL`
+
+		result, err := tx.ExecContext(ctx, query, listID, movieID, stored)
+		if err != nil {
+			switch {
+			case err.Error() == `pq: duplicate key value violates unique constraint "list_entries_pkey"`:
+				return ErrDuplicateListEntry
+			default:
+				return err
+			}
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		return nil
+	})
+}
+
+// RemoveEntry takes the movie out of the list, moving the movies after it up by one.
+func (m MovieListModel) RemoveEntry(listID int64, movieID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, nil, func(tx *sql.Tx) error {
+		err := lockList(ctx, tx, listID)
+		if err != nil {
+			return err
+		}
+
+		query := `
+			DELETE FROM list_entries
+			WHERE list_id = $1 AND movie_id = $2
+			RETURNING position`
+
+		var position int32
+
+		err = tx.QueryRowContext(ctx, query, listID, movieID).Scan(&position)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		query = `
+			UPDATE list_entries
+			SET position = position - 1
+			WHERE list_id = $1 AND position > $2`
+
+		_, err = tx.ExecContext(ctx, query, listID, position)
+		return err
+	})
+}
+
+// ReorderEntries puts the movies of the list in the given order. The movie IDs must be
+// exactly the movies in the list (leaving out those in the trash, which are moved to
+// the end), otherwise ErrInvalidListOrder is returned.
+func (m MovieListModel) ReorderEntries(listID int64, movieIDs []int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, nil, func(tx *sql.Tx) error {
+		err := lockList(ctx, tx, listID)
+		if err != nil {
+			return err
+		}
+
+		query := `
+			SELECT list_entries.movie_id, movies.deleted_at IS NOT NULL
+			FROM list_entries
+			INNER JOIN movies ON movies.id = list_entries.movie_id
+			WHERE list_entries.list_id = $1
+			ORDER BY list_entries.position`
+
+		rows, err := tx.QueryContext(ctx, query, listID)
+		if err != nil {
+			return err
+		}
+
+		visible := map[int64]bool{}
+		var hidden []int64
+
+		for rows.Next() {
+			var movieID int64
+			var deleted bool
+
+			err := rows.Scan(&movieID, &deleted)
+			if err != nil {
+				_ = rows.Close()
+				return err
+			}
+
+			if deleted {
+				hidden = append(hidden, movieID)
+			} else {
+				visible[movieID] = true
+			}
+		}
+
+		if err = rows.Close(); err != nil {
+			return err
+		}
+
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		if len(movieIDs) != len(visible) {
+			return ErrInvalidListOrder
+		}
+
+		for _, movieID := range movieIDs {
+			if !visible[movieID] {
+				return ErrInvalidListOrder
+			}
+
+			// Each movie can only be given once.
+			delete(visible, movieID)
+		}
+
+		order := append(append([]int64{}, movieIDs...), hidden...)
+
+		query = `
+			UPDATE list_entries
+			SET position = new.position
+			FROM unnest($2::bigint[]) WITH ORDINALITY AS new(movie_id, position)
+			WHERE list_entries.list_id = $1 AND list_entries.movie_id = new.movie_id`
+
+		_, err = tx.ExecContext(ctx, query, listID, pq.Array(order))
+		return err
+	})
+}
+
+func movieListScanDest(list *MovieList) []interface{} {
+	return []interface{}{
+		&list.ID,
+		&list.CreatedAt,
+		&list.UserID,
+		&list.Name,
+		&list.Watchlist,
+		&list.Public,
+		&list.ShareToken,
+		&list.Version,
+	}
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 )
@@ -15,6 +16,11 @@ type Models struct {
 	Users       UserModel
 	Tokens      TokenModel
 	Permissions PermissionModel
+	Reviews     ReviewModel
+	People      PersonModel
+	Credits     CreditModel
+	MovieLists  MovieListModel
+	Genres      GenreModel
 }
 
 func NewModels(db *sql.DB) Models {
@@ -31,5 +37,43 @@ func NewModels(db *sql.DB) Models {
 		Permissions: PermissionModel{
 			DB: db,
 		},
+		Reviews: ReviewModel{
+			DB: db,
+		},
+		People: PersonModel{
+			DB: db,
+		},
+		Credits: CreditModel{
+			DB: db,
+		},
+		MovieLists: MovieListModel{
+			DB: db,
+		},
+		Genres: GenreModel{
+			DB: db,
+		},
 	}
 }
+
+// withTx runs fn inside the transaction tx. If tx is nil, fn is run inside a new
+// transaction instead, which is committed if fn succeeds and rolled back otherwise.
+func withTx(ctx context.Context, db *sql.DB, tx *sql.Tx, fn func(tx *sql.Tx) error) error {
+	if tx != nil {
+		return fn(tx)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		// The error from fn is more useful to the caller than any error from
+		// rolling back, so we return it either way.
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -3,13 +3,26 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/lib/pq"
 	"github.com/manunio/greenlight/internal/validator"
+	"regexp"
+	"strings"
 	"time"
 )
 
+var (
+	// ErrDuplicateImdbID and ErrDuplicateTmdbID are returned when another movie
+	// already has the external ID of the movie being written.
+	ErrDuplicateImdbID = errors.New("duplicate imdb id")
+	ErrDuplicateTmdbID = errors.New("duplicate tmdb id")
+)
+
+// ImdbIDRx matches IMDb title IDs.
+var ImdbIDRx = regexp.MustCompile(`^tt[0-9]{7,}$`)
+
 type Movie struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"-"`
@@ -17,7 +30,55 @@ type Movie struct {
 	Year      int32     `json:"year,omitempty"`
 	Runtime   Runtime   `json:"runtime,omitempty"`
 	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	// OriginalTitle is only set when Title has been replaced by a localized title
+	// (see Localize()), and holds the title as it is stored.
+	OriginalTitle string `json:"original_title,omitempty"`
+	// Titles are the localized titles of the movie, keyed by locale. Like the
+	// external IDs they aren't recorded in the movie history.
+	Titles Titles `json:"titles,omitempty"`
+	// Releases are the releases of the movie in each country. They are only loaded by
+	// GetReleases(), and only saved by Insert() and SetReleases().
+	Releases []*Release `json:"releases,omitempty"`
+	// ImdbID and TmdbID are the optional IDs of the movie on IMDb (like "tt0111161")
+	// and TMDB. No two movies can have the same external ID. They aren't recorded in
+	// the movie history.
+	ImdbID  string `json:"imdb_id,omitempty"`
+	TmdbID  int64  `json:"tmdb_id,omitempty"`
+	Version int32  `json:"version"`
+	// AverageRating and RatingCount summarize the scores of the movie's reviews. They
+	// are kept up to date by ReviewModel, and aren't part of the versioned movie.
+	AverageRating float64 `json:"average_rating"`
+	RatingCount   int32   `json:"rating_count"`
+	// PosterID identifies the current poster of the movie (see posterURLs()), and is
+	// empty if the movie has no poster.
+	PosterID string `json:"-"`
+	// Relevance is how well the movie matched the title search when listing movies.
+	// It is only set (and sent to clients) when a title was searched for.
+	Relevance float64 `json:"relevance,omitempty"`
+	// Similarity is how similar the movie is to another one, between 0 and 1. It is
+	// only set for movies listed by GetSimilar().
+	Similarity float64 `json:"similarity,omitempty"`
+	// Highlight is the title with the words matching the title search wrapped in
+	// markers. It is only set when highlighting was requested.
+	Highlight string `json:"highlight,omitempty"`
+	// highlights are the localized titles highlighted in the same way, which
+	// Localize() uses in place of Highlight.
+	highlights Titles
+	// DeletedAt is the time the movie was moved to the trash. It is only set for
+	// movies listed by GetTrash().
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// MarshalJSON adds the URLs of the movie's posters to its JSON representation.
+func (movie Movie) MarshalJSON() ([]byte, error) {
+	// The alias type has the same fields but not this method, so that encoding it
+	// doesn't recurse.
+	type alias Movie
+
+	return json.Marshal(struct {
+		alias
+		Posters map[string]string `json:"posters,omitempty"`
+	}{alias(movie), posterURLs(movie.ID, movie.PosterID)})
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -36,51 +97,249 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
 
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+
+	ValidateTitles(v, movie.Titles)
+	ValidateReleases(v, movie.Releases)
+
+	v.Check(movie.ImdbID == "" || validator.Matches(movie.ImdbID, ImdbIDRx), "imdb_id", `must be an IMDb title ID like "tt0111161"`)
+	v.Check(movie.TmdbID >= 0, "tmdb_id", "must be a positive integer")
+}
+
+// MovieSearch holds the criteria used to narrow down the movies returned by GetAll().
+// Zero values mean that the corresponding filter isn't applied.
+type MovieSearch struct {
+	Title  string
+	Genres []string
+	// Fuzzy enables typo-tolerant title matching based on trigram similarity, in
+	// addition to the full-text search.
+	Fuzzy bool
+	// Highlight requests the matched words of the title to be wrapped in the
+	// HighlightStart and HighlightStop markers, which is done by ts_headline().
+	Highlight      bool
+	HighlightStart string
+	HighlightStop  string
+	YearMin        int
+	YearMax        int
+	RuntimeMin     Runtime
+	RuntimeMax     Runtime
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	// PersonID restricts the movies to those the person is credited on.
+	PersonID int64
+	// ImdbID and TmdbID look up the movie with the given external ID.
+	ImdbID string
+	TmdbID int64
+	// ReleasedIn restricts the movies to those which have been released in the
+	// country (by today).
+	ReleasedIn string
+	// MaxCertification restricts the movies to those certified in the ReleasedIn
+	// country as no more restrictive than it. Movies without a certification there
+	// are left out, as their suitability isn't known.
+	MaxCertification string
+}
+
+func ValidateMovieSearch(v *validator.Validator, search MovieSearch) {
+	v.Check(search.YearMin == 0 || search.YearMin >= 1888, "year_min", "must be greater than 1888")
+	v.Check(search.YearMax == 0 || search.YearMax >= 1888, "year_max", "must be greater than 1888")
+	v.Check(search.YearMin == 0 || search.YearMax == 0 || search.YearMin <= search.YearMax, "year_max", "must not be less than year_min")
+
+	v.Check(search.ImdbID == "" || validator.Matches(search.ImdbID, ImdbIDRx), "imdb_id", `must be an IMDb title ID like "tt0111161"`)
+	v.Check(search.TmdbID >= 0, "tmdb_id", "must be a positive integer")
+
+	v.Check(search.ReleasedIn == "" || validator.Matches(search.ReleasedIn, CountryRx), "released_in", `must be an ISO 3166-1 alpha-2 country code like "US"`)
+
+	if search.MaxCertification != "" {
+		v.Check(search.ReleasedIn != "", "max_certification", "can only be used together with released_in")
+		v.Check(search.ReleasedIn == "" || CertificationsUpTo(search.ReleasedIn, search.MaxCertification) != nil, "max_certification", "must be one of the certifications used in the released_in country")
+	}
+
+	v.Check(search.RuntimeMin >= 0, "runtime_min", "must be a positive integer")
+	v.Check(search.RuntimeMax >= 0, "runtime_max", "must be a positive integer")
+	v.Check(search.RuntimeMin == 0 || search.RuntimeMax == 0 || search.RuntimeMin <= search.RuntimeMax, "runtime_max", "must not be less than runtime_min")
+
+	v.Check(search.CreatedAfter.IsZero() || search.CreatedBefore.IsZero() || search.CreatedAfter.Before(search.CreatedBefore), "created_before", "must be later than created_after")
+
+	v.Check(search.PersonID >= 0, "person_id", "must be a positive integer")
+
+	if search.Highlight {
+		v.Check(search.Title != "", "highlight", "can only be used together with title")
+
+		// The markers are passed to ts_headline() inside double quotes, so they can't
+		// contain one themselves.
+		v.Check(search.HighlightStart != "", "highlight_start", "must be provided")
+		v.Check(len(search.HighlightStart) <= 20, "highlight_start", "must not be more than 20 bytes long")
+		v.Check(!strings.Contains(search.HighlightStart, `"`), "highlight_start", "must not contain double quotes")
+		v.Check(search.HighlightStop != "", "highlight_stop", "must be provided")
+		v.Check(len(search.HighlightStop) <= 20, "highlight_stop", "must not be more than 20 bytes long")
+		v.Check(!strings.Contains(search.HighlightStop, `"`), "highlight_stop", "must not contain double quotes")
+	}
+}
+
+// conditions returns the WHERE conditions matching the search, along with the
+// arguments for their placeholders. The title is always the $1 argument and the genres
+// the $2 argument, so that other parts of a query can refer to them.
+func (search MovieSearch) conditions() ([]string, []interface{}) {
+	args := []interface{}{search.Title, pq.Array(search.Genres)}
+	conditions := []string{
+		"(to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR to_tsvector('simple', titles) @@ plainto_tsquery('simple', $1) OR $1 = '')",
+		"(genres @> $2 OR $2 = '{}')",
+		"deleted_at IS NULL",
+	}
+
+	// In fuzzy mode we also accept titles where the search value is similar enough to
+	// some part of the title (the <% operator, which can use the trigram index on the
+	// title). Only the original title is matched this way.
+	if search.Fuzzy {
+		conditions[0] = "(to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR to_tsvector('simple', titles) @@ plainto_tsquery('simple', $1) OR $1 <% title OR $1 = '')"
+	}
+
+	// addCondition appends a condition comparing against value to the WHERE clause,
+	// interpolating the placeholder for the value into the format string.
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, fmt.Sprintf("$%d", len(args))))
+	}
+
+	// Only add the range filters which were actually requested, so that they don't
+	// get in the way of the planner picking a good index for the others.
+	if search.YearMin != 0 {
+		addCondition("year >= %s", search.YearMin)
+	}
+	if search.YearMax != 0 {
+		addCondition("year <= %s", search.YearMax)
+	}
+	if search.RuntimeMin != 0 {
+		addCondition("runtime >= %s", search.RuntimeMin)
+	}
+	if search.RuntimeMax != 0 {
+		addCondition("runtime <= %s", search.RuntimeMax)
+	}
+	if !search.CreatedAfter.IsZero() {
+		addCondition("created_at > %s", search.CreatedAfter)
+	}
+	if !search.CreatedBefore.IsZero() {
+		addCondition("created_at < %s", search.CreatedBefore)
+	}
+	if search.PersonID != 0 {
+		addCondition("EXISTS (SELECT 1 FROM credits WHERE credits.movie_id = movies.id AND credits.person_id = %s)", search.PersonID)
+	}
+	if search.ImdbID != "" {
+		addCondition("imdb_id = %s", search.ImdbID)
+	}
+	if search.TmdbID != 0 {
+		addCondition("tmdb_id = %s", search.TmdbID)
+	}
+	if search.ReleasedIn != "" {
+		addCondition("EXISTS (SELECT 1 FROM releases WHERE releases.movie_id = movies.id AND releases.country = %s AND releases.release_date <= CURRENT_DATE)", search.ReleasedIn)
+	}
+	if search.MaxCertification != "" {
+		// Every certification the movie was given in the country must be allowed. The
+		// bool_and() of no rows is NULL, which leaves out uncertified movies.
+		args = append(args, search.ReleasedIn, pq.Array(CertificationsUpTo(search.ReleasedIn, search.MaxCertification)))
+		conditions = append(conditions, fmt.Sprintf("(SELECT bool_and(releases.certification = ANY($%d)) FROM releases WHERE releases.movie_id = movies.id AND releases.country = $%d AND releases.certification <> '')", len(args), len(args)-1))
+	}
+
+	return conditions, args
 }
 
 type MovieModel struct {
 	DB *sql.DB
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+// Insert adds a new movie, recording its first version in the movie history as made by
+// the user with the given ID. If tx is not nil the movie is inserted as part of that
+// transaction.
+func (m MovieModel) Insert(tx *sql.Tx, movie *Movie, userID int64) error {
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (title, year, runtime, genres, imdb_id, tmdb_id, titles)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id, created_at, version`
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ImdbID, movie.TmdbID, movie.Titles}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	return withTx(ctx, m.DB, tx, func(tx *sql.Tx) error {
+		err := checkExternalIDs(ctx, tx, movie)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+		if err != nil {
+			return externalIDError(err)
+		}
+
+		if len(movie.Releases) > 0 {
+			err = m.SetReleases(tx, movie.ID, movie.Releases)
+			if err != nil {
+				return err
+			}
+		}
+
+		return insertMovieVersion(ctx, tx, movie, userID)
+	})
 }
 
 func (m MovieModel) Get(id int64) (*Movie, error) {
+	return m.GetFields(id, nil)
+}
+
+// GetFields is like Get(), but only selects the columns for the given fields (see
+// MovieFieldSafelist). The other fields of the returned movie are left empty.
+func (m MovieModel) GetFields(id int64, fields []string) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+	columns := movieColumns(fields)
+
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM movies
-		WHERE id = $1`
+		WHERE id = $1 AND deleted_at IS NULL`, strings.Join(columns, ", "))
 
 	var movie Movie
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&movie.ID,
-		&movie.CreatedAt,
-		&movie.Title,
-		&movie.Year,
-		&movie.Runtime,
-		pq.Array(&movie.Genres),
-		&movie.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(movieScanDest(&movie, columns)...)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &movie, nil
+}
+
+// GetForUpdate fetches the movie inside the transaction tx and locks it until the
+// transaction ends, so that its version can't change before tx updates or deletes it.
+func (m MovieModel) GetForUpdate(tx *sql.Tx, id int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	columns := movieColumns(nil)
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM movies
+		WHERE id = $1 AND deleted_at IS NULL
+		FOR UPDATE`, strings.Join(columns, ", "))
+
+	var movie Movie
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
+	err := tx.QueryRowContext(ctx, query, id).Scan(movieScanDest(&movie, columns)...)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -93,11 +352,14 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+// Update saves the changes to the movie and increments its version, recording the new
+// version in the movie history as made by the user with the given ID. If tx is not nil
+// the movie is updated as part of that transaction.
+func (m MovieModel) Update(tx *sql.Tx, movie *Movie, userID int64) error {
 	query := `
 		UPDATE movies
-		SET title = $1, year = $2, runtime 	= $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET title = $1, year = $2, runtime 	= $3, genres = $4, imdb_id = $5, tmdb_id = $6, titles = $7, version = version + 1
+		WHERE id = $8 AND version = $9 AND deleted_at IS NULL
 		RETURNING version`
 
 	args := []interface{}{
@@ -105,6 +367,9 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Year,
 		movie.Runtime,
 		pq.Array(movie.Genres),
+		movie.ImdbID,
+		movie.TmdbID,
+		movie.Titles,
 		movie.ID,
 		movie.Version,
 	}
@@ -112,49 +377,129 @@ func (m MovieModel) Update(movie *Movie) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
+	return withTx(ctx, m.DB, tx, func(tx *sql.Tx) error {
+		err := checkExternalIDs(ctx, tx, movie)
+		if err != nil {
 			return err
 		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return externalIDError(err)
+			}
+		}
+
+		return insertMovieVersion(ctx, tx, movie, userID)
+	})
+}
+
+// Delete moves the movie to the trash by setting its deleted_at timestamp. Movies in
+// the trash are left out of every other query, and can be brought back with Restore()
+// until they are purged. If tx is not nil the movie is deleted as part of that
+// transaction.
+func (m MovieModel) Delete(tx *sql.Tx, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
 	}
 
-	return nil
+	query := `
+		UPDATE movies
+		SET deleted_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, tx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		return nil
+	})
 }
 
-func (m MovieModel) Delete(id int64) error {
+// DeleteVersion moves the movie to the trash like Delete(), but only if it still has
+// the given version, returning ErrEditConflict otherwise.
+func (m MovieModel) DeleteVersion(tx *sql.Tx, id int64, version int32) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
-		DELETE FROM movies
-		WHERE id = $1`
+		UPDATE movies
+		SET deleted_at = NOW()
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
+	return withTx(ctx, m.DB, tx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, id, version)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrEditConflict
+		}
+
+		return nil
+	})
+}
+
+// relevance returns the SQL expression for the relevance of a match, which is its
+// full-text rank against the original or the best matching localized title. In fuzzy
+// mode the similarity of the title to the search value also counts towards the
+// relevance, so that a misspelled word still ranks the movie highly.
+func (search MovieSearch) relevance() string {
+	if search.Title == "" {
+		return "0::float8"
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
+	if search.Fuzzy {
+		return "greatest(ts_rank(to_tsvector('simple', title), plainto_tsquery('simple', $1)), ts_rank(to_tsvector('simple', titles), plainto_tsquery('simple', $1)), word_similarity($1, title))::float8"
 	}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	return "greatest(ts_rank(to_tsvector('simple', title), plainto_tsquery('simple', $1)), ts_rank(to_tsvector('simple', titles), plainto_tsquery('simple', $1)))::float8"
+}
+
+// sortKeys returns the sort keys of the filters for a search. Relevance is ordered
+// from the best to the worst match, so that "relevance" works the way clients expect.
+// "-relevance" gives the reverse order.
+func (search MovieSearch) sortKeys(filters Filters) []sortKey {
+	keys := filters.sortKeys()
+
+	for i := range keys {
+		if keys[i].column == "relevance" {
+			keys[i].desc = !keys[i].desc
+			keys[i].sql = search.relevance()
+		}
 	}
 
-	return nil
+	return keys
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) (movies []*Movie, metadata Metadata, err error) {
+func (m MovieModel) GetAll(search MovieSearch, filters Filters) (movies []*Movie, metadata Metadata, err error) {
 
 	// 	The to_tsvector('simple', title) function takes a movie title and splits it into lexemes. We specify
 	// 	the simple configuration, which means that the lexemes are just lowercase versions of the words in the
@@ -176,26 +521,82 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) (movi
 	// query should return, and OFFSET allows you to ‘skip’ a specific number of
 	// rows before starting to return records from the query.
 
+	// When paging with a cursor we restrict the results to the rows after the cursor
+	// position instead of skipping rows with OFFSET. We also don't count the matching
+	// records in that mode, as doing so would mean scanning every one of them again.
+	keys := search.sortKeys(filters)
+	relevance := search.relevance()
+
+	conditions, args := search.conditions()
+
+	// ts_headline() uses the same 'simple' configuration as the search itself, so the
+	// highlighted words are exactly the ones which matched. HighlightAll makes it
+	// return the whole title rather than a fragment of it. Given the jsonb of the
+	// localized titles it highlights each of them.
+	highlight := "'', '{}'::jsonb"
+
+	if search.Highlight {
+		args = append(args, fmt.Sprintf(`StartSel="%s", StopSel="%s", HighlightAll=true`, search.HighlightStart, search.HighlightStop))
+		highlight = fmt.Sprintf("ts_headline('simple', title, plainto_tsquery('simple', $1), $%[1]d), ts_headline('simple', titles, plainto_tsquery('simple', $1), $%[1]d)", len(args))
+	}
+
+	totalRecordsColumn := "count(*) OVER()"
+	backward := false
+
+	if filters.Cursor != "" {
+		c, err := decodeCursor(filters.Cursor)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		var condition string
+		condition, args = keysetCondition(keys, c, args)
+		conditions = append(conditions, condition)
+
+		totalRecordsColumn = "0"
+		backward = c.Backward
+	}
+
+	args = append(args, filters.limit(), filters.offset())
+
+	// Besides the requested fields we always need the sort columns, as the cursors are
+	// made from their values.
+	var columns []string
+
+	if len(filters.Fields) > 0 {
+		fields := append([]string{}, filters.Fields...)
+		for _, key := range keys {
+			if key.sql == "" {
+				fields = append(fields, key.column)
+			}
+		}
+
+		columns = movieColumns(fields)
+	} else {
+		columns = movieColumns(nil)
+	}
+
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT %s, %s, %s, %s
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres @> $2 OR $2 = '{}')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		WHERE %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d`,
+		totalRecordsColumn, strings.Join(columns, ", "), relevance, highlight, strings.Join(conditions, "\n\t\tAND "), orderBy(keys, backward), len(args)-1, len(args))
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
-
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
 
 	defer func() {
-		err = rows.Close()
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
 	}()
 
 	totalRecords := 0
@@ -204,16 +605,11 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) (movi
 	for rows.Next() {
 		var movie Movie
 
-		err := rows.Scan(
-			&totalRecords,
-			&movie.ID,
-			&movie.CreatedAt,
-			&movie.Title,
-			&movie.Year,
-			&movie.Runtime,
-			pq.Array(&movie.Genres),
-			&movie.Version,
-		)
+		dest := []interface{}{&totalRecords}
+		dest = append(dest, movieScanDest(&movie, columns)...)
+		dest = append(dest, &movie.Relevance, &movie.Highlight, &movie.highlights)
+
+		err := rows.Scan(dest...)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -225,7 +621,272 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) (movi
 		return nil, Metadata{}, err
 	}
 
-	metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	var hasNext, hasPrev bool
+
+	if filters.Cursor == "" {
+		metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+		hasNext = filters.Page < metadata.LastPage
+		hasPrev = filters.Page > 1
+	} else {
+		// Drop the extra row we fetched to find out whether there are more results in
+		// the direction we're paging. When paging backwards the rows were fetched in
+		// reverse order, so we flip them back before returning them.
+		hasMore := len(movies) > filters.PageSize
+		if hasMore {
+			movies = movies[:filters.PageSize]
+		}
+
+		if backward {
+			for i, j := 0, len(movies)-1; i < j; i, j = i+1, j-1 {
+				movies[i], movies[j] = movies[j], movies[i]
+			}
+		}
+
+		metadata = Metadata{PageSize: filters.PageSize}
+
+		if backward {
+			hasNext = true
+			hasPrev = hasMore
+		} else {
+			hasNext = hasMore
+			hasPrev = true
+		}
+	}
+
+	if len(movies) > 0 {
+		first := movieSortValues(movies[0], keys)
+		last := movieSortValues(movies[len(movies)-1], keys)
+
+		err = filters.setCursors(&metadata, hasNext, hasPrev, first, last)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
 
 	return movies, metadata, nil
 }
+
+// Export calls fn for each of the movies matching the search, in the order given by
+// the sort of the filters (the paging filters are ignored). The movies are handed to
+// fn one at a time as they are read off the database cursor, so exporting the whole
+// catalog doesn't need any more memory than exporting a single movie. There is no
+// timeout on the query, instead it runs until ctx is cancelled. Exporting stops at the
+// first error returned by fn.
+func (m MovieModel) Export(ctx context.Context, search MovieSearch, filters Filters, fn func(movie *Movie) error) (err error) {
+	keys := search.sortKeys(filters)
+	columns := movieColumns(nil)
+
+	conditions, args := search.conditions()
+
+	query := fmt.Sprintf(`
+		SELECT %s, %s
+		FROM movies
+		WHERE %s
+		ORDER BY %s`,
+		strings.Join(columns, ", "), search.relevance(), strings.Join(conditions, "\n\t\tAND "), orderBy(keys, false))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	// The same Movie is reused for every row, so fn mustn't hold on to it.
+	var movie Movie
+
+	dest := append(movieScanDest(&movie, columns), &movie.Relevance)
+
+	for rows.Next() {
+		movie.Genres = nil
+
+		err = rows.Scan(dest...)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// MovieFieldSafelist holds the movie fields which clients can restrict the responses
+// to with the fields query string parameter. The posters field is read from the
+// poster_id column.
+var MovieFieldSafelist = []string{"id", "title", "titles", "year", "runtime", "genres", "imdb_id", "tmdb_id", "version", "average_rating", "rating_count", "posters"}
+
+// movieColumns returns the columns to select for the given fields, in the order of
+// MovieFieldSafelist. The id and version columns are always selected, as the version
+// is needed for the ETag header, and the title brings the localized titles along
+// with it, as they are needed to pick the title in the client's language (they are
+// only sent if they were asked for too). If no fields are given all the columns are
+// selected, including created_at.
+func movieColumns(fields []string) []string {
+	if len(fields) == 0 {
+		return []string{"id", "created_at", "title", "titles", "year", "runtime", "genres", "imdb_id", "tmdb_id", "version", "average_rating", "rating_count", "poster_id"}
+	}
+
+	columns := []string{"id", "version"}
+
+	for _, field := range MovieFieldSafelist {
+		column := field
+		if field == "posters" {
+			column = "poster_id"
+		}
+
+		if !validator.In(column, columns...) && (validator.In(field, fields...) || field == "titles" && validator.In("title", fields...)) {
+			columns = append(columns, column)
+		}
+	}
+
+	return columns
+}
+
+// movieScanDest returns the destinations in movie to scan the given columns into.
+func movieScanDest(movie *Movie, columns []string) []interface{} {
+	dest := make([]interface{}, len(columns))
+
+	for i, column := range columns {
+		switch column {
+		case "id":
+			dest[i] = &movie.ID
+		case "created_at":
+			dest[i] = &movie.CreatedAt
+		case "title":
+			dest[i] = &movie.Title
+		case "titles":
+			dest[i] = &movie.Titles
+		case "year":
+			dest[i] = &movie.Year
+		case "runtime":
+			dest[i] = &movie.Runtime
+		case "genres":
+			dest[i] = pq.Array(&movie.Genres)
+		case "imdb_id":
+			dest[i] = &movie.ImdbID
+		case "tmdb_id":
+			dest[i] = &movie.TmdbID
+		case "version":
+			dest[i] = &movie.Version
+		case "average_rating":
+			dest[i] = &movie.AverageRating
+		case "rating_count":
+			dest[i] = &movie.RatingCount
+		case "poster_id":
+			dest[i] = &movie.PosterID
+		default:
+			panic("unknown movie column: " + column)
+		}
+	}
+
+	return dest
+}
+
+// movieSortValues returns the values of the given sort keys for a movie, which are
+// stored in the cursors used for keyset pagination.
+func movieSortValues(movie *Movie, keys []sortKey) []interface{} {
+	values := make([]interface{}, len(keys))
+
+	for i, key := range keys {
+		switch key.column {
+		case "id":
+			values[i] = movie.ID
+		case "title":
+			values[i] = movie.Title
+		case "year":
+			values[i] = movie.Year
+		case "runtime":
+			values[i] = int32(movie.Runtime)
+		case "average_rating":
+			values[i] = movie.AverageRating
+		case "rating_count":
+			values[i] = movie.RatingCount
+		case "relevance":
+			values[i] = movie.Relevance
+		default:
+			panic("unknown sort column: " + key.column)
+		}
+	}
+
+	return values
+}
+
+// Suggestion is a movie title matching the prefix the user has typed so far, as
+// returned by MovieModel.Suggest().
+type Suggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Year  int32  `json:"year"`
+}
+
+func ValidateSuggestQuery(v *validator.Validator, query string, limit int) {
+	v.Check(query != "", "q", "must be provided")
+	v.Check(len(query) <= 100, "q", "must not be more than 100 bytes long")
+
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 25, "limit", "must be a maximum of 25")
+}
+
+// Suggest returns up to limit movies whose title starts with the query, followed by
+// movies with a word in the title starting with it. Titles which start with the query
+// are served by the movies_title_prefix_idx index and word prefixes by the trigram
+// index on the title.
+func (m MovieModel) Suggest(query string, limit int) (suggestions []*Suggestion, err error) {
+	stmt := `
+		SELECT id, title, year
+		FROM movies
+		WHERE (lower(title) LIKE lower($1) || '%' OR title ILIKE '% ' || $1 || '%')
+		AND deleted_at IS NULL
+		ORDER BY lower(title) LIKE lower($1) || '%' DESC, length(title), title, id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, escapeLike(query), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	suggestions = []*Suggestion{}
+
+	for rows.Next() {
+		var suggestion Suggestion
+
+		err := rows.Scan(&suggestion.ID, &suggestion.Title, &suggestion.Year)
+		if err != nil {
+			return nil, err
+		}
+
+		suggestions = append(suggestions, &suggestion)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return suggestions, nil
+}
+
+// escapeLike escapes the characters which have a special meaning in a LIKE pattern, so
+// that user input is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
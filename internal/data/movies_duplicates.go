@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// normalizedTitle is the SQL expression for the title used to detect duplicates: the
+// title in lower case with everything but letters and digits removed, so that "Se7en"
+// and "se7en." are the same title. It is indexed together with the year.
+const normalizedTitle = `regexp_replace(lower(%s), '[^[:alnum:]]+', '', 'g')`
+
+// checkExternalIDs returns ErrDuplicateImdbID or ErrDuplicateTmdbID if another movie
+// (including one in the trash) already has one of the external IDs of the movie. The
+// unique indexes would catch this too, but a failed statement aborts the whole
+// transaction, which may be running a batch or an import.
+func checkExternalIDs(ctx context.Context, tx *sql.Tx, movie *Movie) error {
+	if movie.ImdbID == "" && movie.TmdbID == 0 {
+		return nil
+	}
+
+	query := `
+		SELECT imdb_id = $1 AND $1 <> ''
+		FROM movies
+		WHERE id <> $3 AND ((imdb_id = $1 AND $1 <> '') OR (tmdb_id = $2 AND $2 <> 0))
+		LIMIT 1`
+
+	var imdb bool
+
+	err := tx.QueryRowContext(ctx, query, movie.ImdbID, movie.TmdbID, movie.ID).Scan(&imdb)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return err
+	case imdb:
+		return ErrDuplicateImdbID
+	default:
+		return ErrDuplicateTmdbID
+	}
+}
+
+// externalIDError maps the errors from the unique indexes on the external IDs, which
+// only happen when two movies with the same ID are written at the same time.
+func externalIDError(err error) error {
+	switch {
+	case err.Error() == `pq: duplicate key value violates unique constraint "movies_imdb_id_key"`:
+		return ErrDuplicateImdbID
+	case err.Error() == `pq: duplicate key value violates unique constraint "movies_tmdb_id_key"`:
+		return ErrDuplicateTmdbID
+	default:
+		return err
+	}
+}
+
+// FindDuplicate returns the movie which the given (new) movie is most likely a
+// duplicate of: one with the same external ID, or failing that (and if byTitle is
+// true) one with the same normalized title and year. Movies in the trash are only
+// matched on their external IDs, which they keep, and have their DeletedAt set. It
+// returns ErrRecordNotFound if there is no such movie.
+func (m MovieModel) FindDuplicate(movie *Movie, byTitle bool) (*Movie, error) {
+	if !byTitle && movie.ImdbID == "" && movie.TmdbID == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	columns := movieColumns(nil)
+
+	query := fmt.Sprintf(`
+		SELECT %s, deleted_at
+		FROM movies
+		WHERE (imdb_id = $1 AND $1 <> '')
+			OR (tmdb_id = $2 AND $2 <> 0)
+			OR ($5 AND %s = %s AND year = $4 AND deleted_at IS NULL)
+		ORDER BY (imdb_id = $1 AND $1 <> '') OR (tmdb_id = $2 AND $2 <> 0) DESC, id
+		LIMIT 1`, strings.Join(columns, ", "), fmt.Sprintf(normalizedTitle, "title"), fmt.Sprintf(normalizedTitle, "$3"))
+
+	var duplicate Movie
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{movie.ImdbID, movie.TmdbID, movie.Title, movie.Year, byTitle}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(append(movieScanDest(&duplicate, columns), &duplicate.DeletedAt)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &duplicate, nil
+}
+
+// Merge folds the duplicate movie into the survivor, in a single transaction:
+//
+//   - the survivor takes over the external IDs of the duplicate which it doesn't have
+//     itself, recording a new version of the survivor made by userID
+//   - the reviews, credits and list entries of the duplicate are moved to the survivor,
+//     except those the survivor already has (by the same user, of the same person in
+//     the same role, or in the same list), and the ratings of both are recounted
+//   - the duplicate is moved to the trash, without its external IDs
+//
+// The other fields of the survivor, including its poster, are kept as they are. It
+// returns ErrRecordNotFound if either movie doesn't exist.
+func (m MovieModel) Merge(duplicateID, survivorID, userID int64) (*Movie, error) {
+	if duplicateID < 1 || survivorID < 1 || duplicateID == survivorID {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var survivor *Movie
+
+	err := withTx(ctx, m.DB, nil, func(tx *sql.Tx) error {
+		// Lock the movies in the order of their IDs, so that two merges of the same
+		// movies can't deadlock.
+		ids := []int64{duplicateID, survivorID}
+		if duplicateID > survivorID {
+			ids = []int64{survivorID, duplicateID}
+		}
+
+		locked := make(map[int64]*Movie, 2)
+
+		for _, id := range ids {
+			movie, err := m.GetForUpdate(tx, id)
+			if err != nil {
+				return err
+			}
+
+			locked[id] = movie
+		}
+
+		duplicate := locked[duplicateID]
+		survivor = locked[survivorID]
+
+		query := `
+			UPDATE movies
+			SET imdb_id = '', tmdb_id = 0, deleted_at = NOW()
+			WHERE id = $1`
+
+		_, err := tx.ExecContext(ctx, query, duplicate.ID)
+		if err != nil {
+			return err
+		}
+
+		if survivor.ImdbID == "" {
+			survivor.ImdbID = duplicate.ImdbID
+		}
+
+		if survivor.TmdbID == 0 {
+			survivor.TmdbID = duplicate.TmdbID
+		}
+
+		// Update() runs inside tx, and so records the new version in the history too.
+		err = m.Update(tx, survivor, userID)
+		if err != nil {
+			return err
+		}
+
+		queries := []string{
+			`UPDATE reviews
+			SET movie_id = $2
+			WHERE movie_id = $1 AND user_id NOT IN (SELECT user_id FROM reviews WHERE movie_id = $2)`,
+
+			`UPDATE credits
+			SET movie_id = $2
+			WHERE movie_id = $1 AND NOT EXISTS (
+				SELECT 1 FROM credits AS existing
+				WHERE existing.movie_id = $2 AND existing.person_id = credits.person_id AND existing.role = credits.role
+			)`,
+
+			`UPDATE list_entries
+			SET movie_id = $2
+			WHERE movie_id = $1 AND list_id NOT IN (SELECT list_id FROM list_entries WHERE movie_id = $2)`,
+
+			`UPDATE movies
+			SET rating_sum = coalesce((SELECT sum(score) FROM reviews WHERE movie_id = movies.id), 0),
+				rating_count = (SELECT count(*) FROM reviews WHERE movie_id = movies.id)
+			WHERE id IN ($1, $2)`,
+		}
+
+		for _, query := range queries {
+			_, err := tx.ExecContext(ctx, query, duplicate.ID, survivor.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Get(survivor.ID)
+}
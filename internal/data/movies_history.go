@@ -0,0 +1,140 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+// MovieVersion is a past (or the current) version of a movie, as recorded in the
+// movies_history table every time a movie is inserted or updated.
+type MovieVersion struct {
+	MovieID  int64     `json:"movie_id"`
+	Version  int32     `json:"version"`
+	Title    string    `json:"title"`
+	Year     int32     `json:"year"`
+	Runtime  Runtime   `json:"runtime"`
+	Genres   []string  `json:"genres"`
+	EditedBy *int64    `json:"edited_by"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+// insertMovieVersion records the current version of the movie in the movie history.
+// It is called in the same transaction as the change itself, so that the history can't
+// get out of step with the movies table.
+func insertMovieVersion(ctx context.Context, tx *sql.Tx, movie *Movie, userID int64) error {
+	query := `
+		INSERT INTO movies_history (movie_id, version, title, year, runtime, genres, edited_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	// Record the anonymous user (who has no ID) as NULL.
+	editedBy := sql.NullInt64{Int64: userID, Valid: userID > 0}
+
+	args := []interface{}{movie.ID, movie.Version, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), editedBy}
+
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetVersions returns every recorded version of the movie, newest first. Like the
+// movie itself, the history of a movie in the trash can't be read.
+func (m MovieModel) GetVersions(id int64) (versions []*MovieVersion, err error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT movie_id, version, title, year, runtime, genres, edited_by, edited_at
+		FROM movies_history
+		WHERE movie_id = $1 AND EXISTS (
+			SELECT 1 FROM movies WHERE movies.id = movies_history.movie_id AND movies.deleted_at IS NULL
+		)
+		ORDER BY version DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	versions = []*MovieVersion{}
+
+	for rows.Next() {
+		var version MovieVersion
+
+		err := rows.Scan(movieVersionScanDest(&version)...)
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, &version)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// A movie always has at least one version, so no versions means there is no such
+	// movie.
+	if len(versions) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return versions, nil
+}
+
+// GetVersion returns a specific version of the movie, or ErrRecordNotFound if the
+// movie is in the trash.
+func (m MovieModel) GetVersion(id int64, version int32) (*MovieVersion, error) {
+	if id < 1 || version < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT movie_id, version, title, year, runtime, genres, edited_by, edited_at
+		FROM movies_history
+		WHERE movie_id = $1 AND version = $2 AND EXISTS (
+			SELECT 1 FROM movies WHERE movies.id = movies_history.movie_id AND movies.deleted_at IS NULL
+		)`
+
+	var movieVersion MovieVersion
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, version).Scan(movieVersionScanDest(&movieVersion)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &movieVersion, nil
+}
+
+func movieVersionScanDest(version *MovieVersion) []interface{} {
+	return []interface{}{
+		&version.MovieID,
+		&version.Version,
+		&version.Title,
+		&version.Year,
+		&version.Runtime,
+		pq.Array(&version.Genres),
+		&version.EditedBy,
+		&version.EditedAt,
+	}
+}
@@ -0,0 +1,94 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+// The weights of the parts of the similarity score, which add up to 1.
+const (
+	similarGenresWeight  = 0.5
+	similarTitleWeight   = 0.2
+	similarYearWeight    = 0.2
+	similarRuntimeWeight = 0.1
+)
+
+// similarityScore is the SQL expression for how similar a movie is to the one given by
+// the parameters $1 (genres), $2 (title), $3 (year) and $4 (runtime). It is a weighted
+// sum of:
+//
+//   - the Jaccard index of the genres: the number of genres the movies share, divided
+//     by the number of genres they have between them
+//   - the trigram similarity of the titles, so that "Alien" and "Aliens" match
+//   - the closeness of the years and of the runtimes, which halves with every 5 years
+//     or 15 minutes apart, and is 0 when either movie doesn't have one
+var similarityScore = fmt.Sprintf(`(
+	%v * coalesce(
+		(SELECT count(*) FROM (SELECT unnest(genres) INTERSECT SELECT unnest($1::text[])) AS shared)::float8 /
+		nullif((SELECT count(*) FROM (SELECT unnest(genres) UNION SELECT unnest($1::text[])) AS combined), 0),
+		0) +
+	%v * similarity(title, $2) +
+	%v * CASE WHEN year = 0 OR $3 = 0 THEN 0 ELSE 1 / (1 + abs(year - $3) / 5.0) END +
+	%v * CASE WHEN runtime = 0 OR $4 = 0 THEN 0 ELSE 1 / (1 + abs(runtime - $4) / 15.0) END
+)::float8`, similarGenresWeight, similarTitleWeight, similarYearWeight, similarRuntimeWeight)
+
+// GetSimilar returns the movies most similar to the given one, best match first (see
+// similarityScore). Only movies which share a genre with it or have a similar title
+// are considered, and neither the movie itself nor the movies in the trash are
+// included. The Similarity of each movie is set.
+func (m MovieModel) GetSimilar(movie *Movie, filters Filters) (movies []*Movie, metadata Metadata, err error) {
+	columns := movieColumns(nil)
+
+	// The genres are matched using the GIN index on them, and the titles using the
+	// trigram index.
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s, %s AS similarity
+		FROM movies
+		WHERE id <> $5 AND deleted_at IS NULL AND (genres && $1 OR title %% $2)
+		ORDER BY similarity DESC, id
+		LIMIT $6 OFFSET $7`, strings.Join(columns, ", "), similarityScore)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{pq.Array(movie.Genres), movie.Title, movie.Year, movie.Runtime, movie.ID, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	totalRecords := 0
+	movies = []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		dest := append([]interface{}{&totalRecords}, movieScanDest(&movie, columns)...)
+
+		err := rows.Scan(append(dest, &movie.Similarity)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return movies, metadata, nil
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// MovieStats holds statistics about the movies in the catalog, excluding those in the
+// trash. The years, decades and runtimes only count the movies which have one.
+type MovieStats struct {
+	Total int64 `json:"total"`
+	// Genres holds the number of movies with each genre, Years the number of movies
+	// from each year, and Decades the number of movies from each decade, keyed by its
+	// first year (like 1990).
+	Genres  map[string]int64 `json:"genres"`
+	Years   map[int]int64    `json:"years"`
+	Decades map[int]int64    `json:"decades"`
+	Runtime RuntimeStats     `json:"runtime"`
+	// RefreshedAt is when the statistics were last computed (see RefreshStats()).
+	RefreshedAt time.Time `json:"refreshed_at"`
+}
+
+// RuntimeStats holds the shortest, average, median and longest runtimes, with the
+// average and median rounded to the nearest minute.
+type RuntimeStats struct {
+	Min    Runtime `json:"min"`
+	Avg    Runtime `json:"avg"`
+	Median Runtime `json:"median"`
+	Max    Runtime `json:"max"`
+}
+
+// GetStats returns the catalog statistics as of the last time they were refreshed.
+func (m MovieModel) GetStats() (*MovieStats, error) {
+	query := `
+		SELECT total, genres, years, decades, runtime_min, runtime_avg, runtime_median, runtime_max, refreshed_at
+		FROM movie_stats`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stats MovieStats
+	var genres, years, decades []byte
+	var avg, median float64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(
+		&stats.Total,
+		&genres,
+		&years,
+		&decades,
+		&stats.Runtime.Min,
+		&avg,
+		&median,
+		&stats.Runtime.Max,
+		&stats.RefreshedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(genres, &stats.Genres)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(years, &stats.Years)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(decades, &stats.Decades)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Runtime.Avg = Runtime(math.Round(avg))
+	stats.Runtime.Median = Runtime(math.Round(median))
+
+	return &stats, nil
+}
+
+// RefreshStats recomputes the catalog statistics returned by GetStats(). The old
+// statistics can still be read while they are being recomputed.
+func (m MovieModel) RefreshStats() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `REFRESH MATERIALIZED VIEW CONCURRENTLY movie_stats`)
+
+	return err
+}
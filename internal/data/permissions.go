@@ -10,6 +10,13 @@ import (
 const (
 	MoviesRead  = "movies:read"
 	MoviesWrite = "movies:write"
+
+	ReviewsWrite = "reviews:write"
+	// ReviewsModerate allows deleting the reviews of other users.
+	ReviewsModerate = "reviews:moderate"
+
+	// GenresWrite allows adding genres to the taxonomy and merging them.
+	GenresWrite = "genres:write"
 )
 
 // Permissions slice, which we will use to will hold the permission codes (like
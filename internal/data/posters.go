@@ -0,0 +1,69 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PosterWidths holds the width in pixels of each of the thumbnail sizes generated for
+// a poster. The uploaded image itself is kept as the "original" size.
+var PosterWidths = map[string]int{
+	"small":  92,
+	"medium": 185,
+	"large":  500,
+}
+
+// PosterSizes holds the names of all the poster sizes, in increasing order.
+var PosterSizes = []string{"small", "medium", "large", "original"}
+
+// posterURLs returns the URL of each size of the movie's poster, or nil if it has no
+// poster. The URLs include the poster ID, so they change whenever a new poster is
+// uploaded and can be cached forever.
+func posterURLs(movieID int64, posterID string) map[string]string {
+	if posterID == "" {
+		return nil
+	}
+
+	urls := make(map[string]string, len(PosterSizes))
+
+	for _, size := range PosterSizes {
+		urls[size] = fmt.Sprintf("/v1/movies/%d/poster?size=%s&v=%s", movieID, size, posterID)
+	}
+
+	return urls
+}
+
+// SetPoster makes posterID the current poster of the movie, and returns the ID of the
+// poster it replaced (which is empty if there wasn't one).
+func (m MovieModel) SetPoster(id int64, posterID string) (string, error) {
+	if id < 1 {
+		return "", ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE movies
+		SET poster_id = $1
+		FROM (SELECT id, poster_id FROM movies WHERE id = $2 AND deleted_at IS NULL FOR UPDATE) AS old
+		WHERE movies.id = old.id
+		RETURNING old.poster_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var oldPosterID string
+
+	err := m.DB.QueryRowContext(ctx, query, posterID, id).Scan(&oldPosterID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	return oldPosterID, nil
+}
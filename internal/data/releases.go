@@ -0,0 +1,231 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/manunio/greenlight/internal/validator"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidDateFormat = errors.New(`invalid date format, must be "YYYY-MM-DD"`)
+
+// ReleaseTypes holds the ways a movie can be released in a country.
+var ReleaseTypes = []string{"theatrical", "digital"}
+
+// CountryRx matches ISO 3166-1 alpha-2 country codes, like "US" or "DE".
+var CountryRx = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// Certifications holds the age certifications used in each country, from the least to
+// the most restrictive. Releases in other countries can't be given a certification.
+var Certifications = map[string][]string{
+	"AU": {"G", "PG", "M", "MA15+", "R18+", "X18+"},
+	"BR": {"L", "10", "12", "14", "16", "18"},
+	"CA": {"G", "PG", "14A", "18A", "R"},
+	"DE": {"FSK 0", "FSK 6", "FSK 12", "FSK 16", "FSK 18"},
+	"ES": {"A", "7", "12", "16", "18"},
+	"FR": {"TP", "10", "12", "16", "18"},
+	"GB": {"U", "PG", "12A", "12", "15", "18", "R18"},
+	"IN": {"U", "UA", "A", "S"},
+	"JP": {"G", "PG12", "R15+", "R18+"},
+	"NL": {"AL", "6", "9", "12", "14", "16", "18"},
+	"US": {"G", "PG", "PG-13", "R", "NC-17"},
+}
+
+// CertificationsUpTo returns the certifications of the country which are no more
+// restrictive than max, or nil if max isn't one of them.
+func CertificationsUpTo(country, max string) []string {
+	for i, certification := range Certifications[country] {
+		if certification == max {
+			return Certifications[country][:i+1]
+		}
+	}
+
+	return nil
+}
+
+// Date is a calendar date, which is written to and read from JSON as "YYYY-MM-DD".
+type Date struct {
+	time.Time
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.Format("2006-01-02"))), nil
+}
+
+func (d *Date) UnmarshalJSON(jsonValue []byte) error {
+	unquoted, err := strconv.Unquote(string(jsonValue))
+	if err != nil {
+		return ErrInvalidDateFormat
+	}
+
+	t, err := time.Parse("2006-01-02", unquoted)
+	if err != nil {
+		return ErrInvalidDateFormat
+	}
+
+	d.Time = t
+
+	return nil
+}
+
+// Value implements the driver.Valuer interface.
+func (d Date) Value() (driver.Value, error) {
+	return d.Format("2006-01-02"), nil
+}
+
+// Scan implements the sql.Scanner interface.
+func (d *Date) Scan(src interface{}) error {
+	t, ok := src.(time.Time)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into Date", src)
+	}
+
+	d.Time = t
+
+	return nil
+}
+
+// Release is the release of a movie in a country, either in theatres or digitally,
+// along with the age certification it was given there.
+type Release struct {
+	ID            int64  `json:"id"`
+	MovieID       int64  `json:"-"`
+	Country       string `json:"country"`
+	Type          string `json:"type"`
+	Date          Date   `json:"date"`
+	Certification string `json:"certification,omitempty"`
+}
+
+// ValidateReleases checks the releases of a movie, including that each certification
+// is one used in the country of the release.
+func ValidateReleases(v *validator.Validator, releases []*Release) {
+	v.Check(len(releases) <= 500, "releases", "must not contain more than 500 releases")
+
+	seen := make(map[string]bool, len(releases))
+
+	for i, release := range releases {
+		key := fmt.Sprintf("releases[%d]", i)
+
+		v.Check(validator.Matches(release.Country, CountryRx), key, `country must be an ISO 3166-1 alpha-2 code like "US"`)
+		v.Check(validator.In(release.Type, ReleaseTypes...), key, "type must be theatrical or digital")
+		v.Check(!release.Date.IsZero(), key, "date must be provided")
+		v.Check(release.Date.IsZero() || release.Date.Year() >= 1888, key, "date must not be before 1888")
+
+		if release.Certification != "" {
+			certifications, ok := Certifications[release.Country]
+			v.Check(ok, key, fmt.Sprintf("certification can't be given for releases in %s", release.Country))
+			v.Check(!ok || validator.In(release.Certification, certifications...), key, fmt.Sprintf("certification must be one of those used in %s", release.Country))
+		}
+
+		v.Check(!seen[release.Country+" "+release.Type], key, "must not repeat the country and type of another release")
+		seen[release.Country+" "+release.Type] = true
+	}
+}
+
+// GetReleases returns the releases of the movie, sorted by country and date.
+func (m MovieModel) GetReleases(movieID int64) (releases []*Release, err error) {
+	query := `
+		SELECT id, movie_id, country, type, release_date, certification
+		FROM releases
+		WHERE movie_id = $1
+		ORDER BY country, release_date, type`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	releases = []*Release{}
+
+	for rows.Next() {
+		var release Release
+
+		err := rows.Scan(
+			&release.ID,
+			&release.MovieID,
+			&release.Country,
+			&release.Type,
+			&release.Date,
+			&release.Certification,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		releases = append(releases, &release)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return releases, nil
+}
+
+// SetReleases replaces the releases of the movie. If tx is not nil the releases are
+// replaced as part of that transaction. It returns ErrRecordNotFound if the movie
+// doesn't exist (or is in the trash).
+func (m MovieModel) SetReleases(tx *sql.Tx, movieID int64, releases []*Release) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, tx, func(tx *sql.Tx) error {
+		// Lock the movie, so that it can't be moved to the trash while its releases
+		// are being replaced.
+		query := `
+			SELECT id
+			FROM movies
+			WHERE id = $1 AND deleted_at IS NULL
+			FOR UPDATE`
+
+		var id int64
+
+		err := tx.QueryRowContext(ctx, query, movieID).Scan(&id)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM releases WHERE movie_id = $1`, movieID)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			INSERT INTO releases (movie_id, country, type, release_date, certification)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id`
+
+		for _, release := range releases {
+			release.MovieID = movieID
+
+			args := []interface{}{movieID, release.Country, release.Type, release.Date, release.Certification}
+
+			err := tx.QueryRowContext(ctx, query, args...).Scan(&release.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,263 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/manunio/greenlight/internal/validator"
+	"time"
+)
+
+var (
+	ErrDuplicateReview = errors.New("duplicate review")
+)
+
+type Review struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	MovieID   int64     `json:"movie_id"`
+	UserID    int64     `json:"user_id"`
+	Score     int32     `json:"score"`
+	Text      string    `json:"text"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Score >= 1, "score", "must be at least 1")
+	v.Check(review.Score <= 10, "score", "must not be more than 10")
+
+	v.Check(review.Text != "", "text", "must be provided")
+	v.Check(len(review.Text) <= 10_000, "text", "must not be more than 10000 bytes long")
+}
+
+type ReviewModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a new review and counts its score towards the movie's rating, in a
+// single transaction. It returns ErrRecordNotFound if the movie doesn't exist (or is in
+// the trash), and ErrDuplicateReview if the user has already reviewed the movie.
+func (m ReviewModel) Insert(review *Review) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, nil, func(tx *sql.Tx) error {
+		query := `
+			UPDATE movies
+			SET rating_sum = rating_sum + $1, rating_count = rating_count + 1
+			WHERE id = $2 AND deleted_at IS NULL`
+
+		result, err := tx.ExecContext(ctx, query, review.Score, review.MovieID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		query = `
+			INSERT INTO reviews (movie_id, user_id, score, text)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at, version`
+
+		args := []interface{}{review.MovieID, review.UserID, review.Score, review.Text}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.Version)
+		if err != nil {
+			switch {
+			case err.Error() == `pq: duplicate key value violates unique constraint "reviews_movie_id_user_id_key"`:
+				return ErrDuplicateReview
+			default:
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Get returns the review with the given ID. Reviews of movies in the trash are
+// treated as not existing, like the movies themselves.
+func (m ReviewModel) Get(id int64) (*Review, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, movie_id, user_id, score, text, version
+		FROM reviews
+		WHERE id = $1 AND EXISTS (
+			SELECT 1 FROM movies WHERE movies.id = reviews.movie_id AND movies.deleted_at IS NULL
+		)`
+
+	var review Review
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(reviewScanDest(&review)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &review, nil
+}
+
+// GetAllForMovie returns a page of the reviews of a movie.
+func (m ReviewModel) GetAllForMovie(movieID int64, filters Filters) (reviews []*Review, metadata Metadata, err error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, movie_id, user_id, score, text, version
+		FROM reviews
+		WHERE movie_id = $1
+		ORDER BY %s
+		LIMIT $2 OFFSET $3`, orderBy(filters.sortKeys(), false))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	totalRecords := 0
+	reviews = []*Review{}
+
+	for rows.Next() {
+		var review Review
+
+		dest := append([]interface{}{&totalRecords}, reviewScanDest(&review)...)
+
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return reviews, metadata, nil
+}
+
+// Update saves the changes to the review and increments its version. The movie's
+// rating is adjusted by the change in score in the same transaction. It returns
+// ErrEditConflict if the review has changed, or its movie has been moved to the
+// trash, since it was fetched.
+func (m ReviewModel) Update(review *Review) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, nil, func(tx *sql.Tx) error {
+		// The old score is read from the locked row, as the one the caller has may
+		// already have been changed.
+		query := `
+			UPDATE reviews
+			SET score = $1, text = $2, version = reviews.version + 1
+			FROM (SELECT id, score FROM reviews WHERE id = $3 FOR UPDATE) AS old
+			WHERE reviews.id = old.id AND reviews.version = $4 AND EXISTS (
+				SELECT 1 FROM movies WHERE movies.id = reviews.movie_id AND movies.deleted_at IS NULL
+			)
+			RETURNING reviews.version, old.score`
+
+		args := []interface{}{review.Score, review.Text, review.ID, review.Version}
+
+		var oldScore int32
+
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&review.Version, &oldScore)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		query = `
+			UPDATE movies
+			SET rating_sum = rating_sum + $1
+			WHERE id = $2`
+
+		_, err = tx.ExecContext(ctx, query, review.Score-oldScore, review.MovieID)
+		return err
+	})
+}
+
+// Delete removes the review and takes its score out of the movie's rating. Reviews
+// of movies in the trash can't be deleted, so that the rating is still right if
+// the movie is restored.
+func (m ReviewModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, nil, func(tx *sql.Tx) error {
+		query := `
+			DELETE FROM reviews
+			WHERE id = $1 AND EXISTS (
+				SELECT 1 FROM movies WHERE movies.id = reviews.movie_id AND movies.deleted_at IS NULL
+			)
+			RETURNING movie_id, score`
+
+		var movieID int64
+		var score int32
+
+		err := tx.QueryRowContext(ctx, query, id).Scan(&movieID, &score)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		query = `
+			UPDATE movies
+			SET rating_sum = rating_sum - $1, rating_count = rating_count - 1
+			WHERE id = $2`
+
+		_, err = tx.ExecContext(ctx, query, score, movieID)
+		return err
+	})
+}
+
+func reviewScanDest(review *Review) []interface{} {
+	return []interface{}{
+		&review.ID,
+		&review.CreatedAt,
+		&review.MovieID,
+		&review.UserID,
+		&review.Score,
+		&review.Text,
+		&review.Version,
+	}
+}
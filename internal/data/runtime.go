@@ -34,26 +34,40 @@ func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
 		return ErrInvalidRuntimeFormat
 	}
 
+	// Parse the "<runtime> mins" string, returning ErrInvalidRuntimeFormat if it isn't
+	// in the expected format.
+	runtime, err := ParseRuntime(unquotedJSONValue)
+	if err != nil {
+		return err
+	}
+
+	// Assign the parsed Runtime to the receiver. Note that we use the * operator to
+	// dereference the receiver (which is a pointer to a Runtime type) in order to set
+	// underlying value of the pointer.
+	*r = runtime
+
+	return nil
+}
+
+// ParseRuntime parses a string in the format "<runtime> mins" into a Runtime. This is
+// the same format that is used for runtime values in JSON, and lets us accept it in
+// places like query string parameters too.
+func ParseRuntime(s string) (Runtime, error) {
 	// Split the string to isolate the part containing the number.
-	parts := strings.Split(unquotedJSONValue, " ")
+	parts := strings.Split(s, " ")
 
 	// Sanity check the parts of the string to make sure it was in the expected format.
-	// If it isn't, we return ErrInvalidRuntimeFormat error again
+	// If it isn't, we return the ErrInvalidRuntimeFormat error.
 	if len(parts) != 2 || parts[1] != "mins" {
-		return ErrInvalidRuntimeFormat
+		return 0, ErrInvalidRuntimeFormat
 	}
 
 	// Otherwise, parse the string containing the number to int32, Again, if this
 	// fails return the ErrInvalidRuntimeFormat error.
 	i, err := strconv.ParseInt(parts[0], 10, 32)
 	if err != nil {
-		return ErrInvalidRuntimeFormat
+		return 0, ErrInvalidRuntimeFormat
 	}
 
-	// Convert the int32 to a Runtime type and assign this to the receiver. Note that we use
-	// use the * operator to dereference the receiver (which is a pointer to a Runtime
-	// type) in order to set underlying value of the pointer.
-	*r = Runtime(i)
-
-	return nil
+	return Runtime(i), nil
 }
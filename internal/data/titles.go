@@ -0,0 +1,138 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/manunio/greenlight/internal/validator"
+	"regexp"
+	"strings"
+)
+
+// LocaleRx matches the locales of localized titles: a lower case language code,
+// optionally followed by an upper case region code, like "de", "pt-BR" or "es-419".
+var LocaleRx = regexp.MustCompile(`^[a-z]{2,3}(-([A-Z]{2}|[0-9]{3}))?$`)
+
+// Titles holds the localized titles of a movie, keyed by locale. It is stored as a jsonb
+// object in the titles column.
+type Titles map[string]string
+
+// Value implements the driver.Valuer interface, storing the titles as a JSON object.
+func (t Titles) Value() (driver.Value, error) {
+	if t == nil {
+		return "{}", nil
+	}
+
+	b, err := json.Marshal(map[string]string(t))
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// Scan implements the sql.Scanner interface, reading the titles from a JSON object.
+func (t *Titles) Scan(src interface{}) error {
+	var b []byte
+
+	switch src := src.(type) {
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	case nil:
+		*t = nil
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Titles", src)
+	}
+
+	var titles map[string]string
+
+	err := json.Unmarshal(b, &titles)
+	if err != nil {
+		return errors.New("invalid titles: " + err.Error())
+	}
+
+	// Movies without localized titles have an empty object, which is left out of
+	// the JSON responses like a nil map.
+	if len(titles) == 0 {
+		titles = nil
+	}
+
+	*t = titles
+
+	return nil
+}
+
+func ValidateTitles(v *validator.Validator, titles Titles) {
+	v.Check(len(titles) <= 50, "titles", "must not contain more than 50 titles")
+
+	for locale, title := range titles {
+		v.Check(validator.Matches(locale, LocaleRx), "titles", fmt.Sprintf("must be keyed by locales like \"de\" or \"pt-BR\", not %q", locale))
+		v.Check(title != "", "titles", "must not contain empty titles")
+		v.Check(len(title) <= 500, "titles", "must not contain titles more than 500 bytes long")
+	}
+}
+
+// Localize replaces the title of the movie with its localized title for the first of
+// the locales which it has one for, keeping the original title in OriginalTitle. The
+// locales are matched ignoring case, from the most to the least specific: "de-AT"
+// matches a title for "de-AT", failing that one for "de", and failing that one for any
+// other "de-" locale. It returns the locale of the title used, or "" if the movie has
+// no title for any of the locales.
+func (movie *Movie) Localize(locales []string) string {
+	if len(movie.Titles) == 0 {
+		return ""
+	}
+
+	for _, locale := range locales {
+		if key, ok := movie.Titles.match(locale); ok {
+			// A localized title which is the same as the original one doesn't need
+			// to be pointed out.
+			if movie.Titles[key] != movie.Title {
+				movie.OriginalTitle = movie.Title
+				movie.Title = movie.Titles[key]
+
+				if movie.Highlight != "" && movie.highlights[key] != "" {
+					movie.Highlight = movie.highlights[key]
+				}
+			}
+
+			return key
+		}
+	}
+
+	return ""
+}
+
+// match returns the key of the title matching the locale, if there is one.
+func (t Titles) match(locale string) (string, bool) {
+	locale = strings.ToLower(locale)
+	language := strings.SplitN(locale, "-", 2)[0]
+
+	var exact, base, other string
+
+	for key := range t {
+		lower := strings.ToLower(key)
+
+		switch {
+		case lower == locale:
+			exact = key
+		case lower == language:
+			base = key
+		case strings.HasPrefix(lower, language+"-") && (other == "" || key < other):
+			// Pick the same one every time when there are several.
+			other = key
+		}
+	}
+
+	for _, key := range []string{exact, base, other} {
+		if key != "" {
+			return key, true
+		}
+	}
+
+	return "", false
+}
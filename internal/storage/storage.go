@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrNotFound   = errors.New("object not found")
+	ErrInvalidKey = errors.New("invalid key")
+)
+
+// Storage stores files (like movie posters) under slash-separated keys such as
+// "posters/1/abc/small.jpg". It is an interface so that the files can be kept
+// somewhere other than the local filesystem without changing the handlers.
+type Storage interface {
+	// Put stores the contents of r under the key, replacing any existing file.
+	Put(key string, r io.Reader) error
+	// Get opens the file stored under the key, returning ErrNotFound if there is no
+	// such file. The caller must close it.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes every file whose key starts with the prefix followed by a slash.
+	Delete(prefix string) error
+}
+
+// Local is a Storage which keeps the files in a directory of the local filesystem.
+type Local struct {
+	dir string
+}
+
+// NewLocal returns a Local storage keeping its files in dir, which is created if it
+// doesn't exist.
+func NewLocal(dir string) (*Local, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Local{dir: dir}, nil
+}
+
+// path returns the filesystem path of the key. Keys must not be able to escape the
+// storage directory, so empty, "." and ".." parts are rejected.
+func (l *Local) path(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." || strings.Contains(part, `\`) {
+			return "", ErrInvalidKey
+		}
+	}
+
+	return filepath.Join(l.dir, filepath.FromSlash(key)), nil
+}
+
+func (l *Local) Put(key string, r io.Reader) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first and then rename it, so that readers never see
+	// a partly written file.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (l *Local) Get(key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (l *Local) Delete(prefix string) error {
+	path, err := l.path(prefix)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,4 @@
+-- drops index
+drop index if exists movies_year_idx;
+drop index if exists movies_runtime_idx;
+drop index if exists movies_created_at_idx;
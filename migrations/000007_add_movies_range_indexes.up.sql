@@ -0,0 +1,4 @@
+-- create indexes for the year, runtime and created_at range filters
+create index if not exists movies_year_idx on movies (year);
+create index if not exists movies_runtime_idx on movies (runtime);
+create index if not exists movies_created_at_idx on movies (created_at);
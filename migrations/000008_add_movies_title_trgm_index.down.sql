@@ -0,0 +1,3 @@
+-- drops index
+drop index if exists movies_title_trgm_idx;
+drop extension if exists pg_trgm;
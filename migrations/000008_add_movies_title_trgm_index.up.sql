@@ -0,0 +1,3 @@
+-- enable trigram matching and index the title for fuzzy search
+create extension if not exists pg_trgm;
+create index if not exists movies_title_trgm_idx on movies using gin (title gin_trgm_ops);
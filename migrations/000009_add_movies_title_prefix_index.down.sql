@@ -0,0 +1,2 @@
+-- drops index
+drop index if exists movies_title_prefix_idx;
@@ -0,0 +1,2 @@
+-- create index for title prefix matching (used by the suggest endpoint)
+create index if not exists movies_title_prefix_idx on movies (lower(title) text_pattern_ops);
@@ -0,0 +1,18 @@
+--
+CREATE TABLE IF NOT EXISTS movies_history (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    version integer NOT NULL,
+    title text NOT NULL,
+    year integer NOT NULL,
+    runtime integer NOT NULL,
+    genres text[] NOT NULL,
+    edited_by bigint REFERENCES users ON DELETE SET NULL,
+    edited_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (movie_id, version)
+);
+
+-- Record the current version of the existing movies. We don't know who made those
+-- changes, so edited_by is left empty.
+INSERT INTO movies_history (movie_id, version, title, year, runtime, genres)
+SELECT id, version, title, year, runtime, genres
+FROM movies;
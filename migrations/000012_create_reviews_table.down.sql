@@ -0,0 +1,7 @@
+--
+DROP INDEX IF EXISTS movies_rating_count_idx;
+DROP INDEX IF EXISTS movies_average_rating_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS average_rating;
+ALTER TABLE movies DROP COLUMN IF EXISTS rating_count;
+ALTER TABLE movies DROP COLUMN IF EXISTS rating_sum;
+DROP TABLE IF EXISTS reviews;
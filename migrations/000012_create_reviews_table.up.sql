@@ -0,0 +1,24 @@
+--
+CREATE TABLE IF NOT EXISTS reviews (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    score integer NOT NULL,
+    text text NOT NULL,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT reviews_score_check CHECK (score BETWEEN 1 AND 10),
+    -- a user can only review each movie once
+    CONSTRAINT reviews_movie_id_user_id_key UNIQUE (movie_id, user_id)
+);
+
+-- The sum and count of the review scores are kept on the movies, so that the average
+-- rating can be sorted on without reading the reviews.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS rating_sum integer NOT NULL DEFAULT 0;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS rating_count integer NOT NULL DEFAULT 0;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS average_rating float8 GENERATED ALWAYS AS (
+    CASE WHEN rating_count > 0 THEN round(rating_sum::numeric / rating_count, 2)::float8 ELSE 0 END
+) STORED;
+
+CREATE INDEX IF NOT EXISTS movies_average_rating_idx ON movies (average_rating);
+CREATE INDEX IF NOT EXISTS movies_rating_count_idx ON movies (rating_count);
@@ -0,0 +1,4 @@
+--
+-- poster_id identifies the current poster of the movie, and is empty if it has none.
+-- It changes every time a new poster is uploaded, so that the poster URLs do too.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS poster_id text NOT NULL DEFAULT '';
@@ -0,0 +1,44 @@
+--
+CREATE TABLE IF NOT EXISTS genres (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    slug text NOT NULL,
+    name text NOT NULL,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT genres_slug_key UNIQUE (slug)
+);
+
+-- Every name a genre is known by is an alias of it, including its own slug. Aliases are
+-- stored in slug form, so that "Sci-Fi", "sci fi" and "SCI-FI" are all the same alias.
+CREATE TABLE IF NOT EXISTS genre_aliases (
+    alias text PRIMARY KEY,
+    genre_id bigint NOT NULL REFERENCES genres ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS genre_aliases_genre_id_idx ON genre_aliases (genre_id);
+
+-- The genres already used by movies become the initial taxonomy, and the movies are
+-- rewritten to use their slugs.
+INSERT INTO genres (slug, name)
+SELECT slug, min(genre)
+FROM (
+    SELECT genre, trim(BOTH '-' FROM regexp_replace(lower(genre), '[^[:alnum:]]+', '-', 'g')) AS slug
+    FROM movies, unnest(genres) AS genre
+) AS existing
+GROUP BY slug
+ON CONFLICT DO NOTHING;
+
+INSERT INTO genre_aliases (alias, genre_id)
+SELECT slug, id FROM genres
+ON CONFLICT DO NOTHING;
+
+UPDATE movies
+SET genres = ARRAY(
+    SELECT slug
+    FROM (
+        SELECT trim(BOTH '-' FROM regexp_replace(lower(genre), '[^[:alnum:]]+', '-', 'g')) AS slug, min(position) AS position
+        FROM unnest(movies.genres) WITH ORDINALITY AS existing(genre, position)
+        GROUP BY 1
+    ) AS normalized
+    ORDER BY position
+);
@@ -0,0 +1,15 @@
+--
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS imdb_id text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS tmdb_id bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE movies ADD CONSTRAINT movies_imdb_id_check CHECK (imdb_id = '' OR imdb_id ~ '^tt[0-9]{7,}$');
+ALTER TABLE movies ADD CONSTRAINT movies_tmdb_id_check CHECK (tmdb_id >= 0);
+
+-- The external IDs are optional, so only the movies which have one must have a unique
+-- one.
+CREATE UNIQUE INDEX IF NOT EXISTS movies_imdb_id_key ON movies (imdb_id) WHERE imdb_id <> '';
+CREATE UNIQUE INDEX IF NOT EXISTS movies_tmdb_id_key ON movies (tmdb_id) WHERE tmdb_id <> 0;
+
+-- index the duplicate detection, which compares titles with case, spacing and
+-- punctuation ignored
+CREATE INDEX IF NOT EXISTS movies_normalized_title_year_idx ON movies ((regexp_replace(lower(title), '[^[:alnum:]]+', '', 'g')), year);
@@ -0,0 +1,9 @@
+--
+-- titles holds the localized titles of the movie, keyed by locale, like
+-- {"de": "Der Pate", "pt-BR": "O Poderoso Chefão"}. The title column is the original
+-- title.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS titles jsonb NOT NULL DEFAULT '{}';
+
+-- index the full-text search of the localized titles (to_tsvector() only takes the
+-- values of a jsonb document, not the keys)
+CREATE INDEX IF NOT EXISTS movies_titles_idx ON movies USING GIN (to_tsvector('simple', titles));
@@ -0,0 +1,15 @@
+--
+CREATE TABLE IF NOT EXISTS releases (
+    id bigserial PRIMARY KEY,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    country text NOT NULL,
+    type text NOT NULL,
+    release_date date NOT NULL,
+    certification text NOT NULL DEFAULT '',
+    CONSTRAINT releases_type_check CHECK (type IN ('theatrical', 'digital')),
+    -- a movie is released at most once of each type in each country
+    CONSTRAINT releases_movie_id_country_type_key UNIQUE (movie_id, country, type)
+);
+
+-- index the released_in and max_certification filters
+CREATE INDEX IF NOT EXISTS releases_country_movie_id_idx ON releases (country, movie_id);
@@ -0,0 +1,2 @@
+--
+DROP MATERIALIZED VIEW IF EXISTS movie_stats;
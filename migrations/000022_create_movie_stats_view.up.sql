@@ -0,0 +1,37 @@
+--
+-- movie_stats holds the catalog statistics in a single row, so that they don't have to
+-- be computed over every movie on each request. It is refreshed periodically by the
+-- application. Movies in the trash aren't counted, and neither are unknown (zero)
+-- years and runtimes.
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_stats AS
+SELECT
+    1 AS id,
+    (SELECT count(*) FROM movies WHERE deleted_at IS NULL) AS total,
+    coalesce((
+        SELECT jsonb_object_agg(genre, count)
+        FROM (SELECT unnest(genres) AS genre, count(*) FROM movies WHERE deleted_at IS NULL GROUP BY genre) AS counts
+    ), '{}') AS genres,
+    coalesce((
+        SELECT jsonb_object_agg(year, count)
+        FROM (SELECT year, count(*) FROM movies WHERE deleted_at IS NULL AND year <> 0 GROUP BY year) AS counts
+    ), '{}') AS years,
+    coalesce((
+        SELECT jsonb_object_agg(decade, count)
+        FROM (SELECT year / 10 * 10 AS decade, count(*) FROM movies WHERE deleted_at IS NULL AND year <> 0 GROUP BY decade) AS counts
+    ), '{}') AS decades,
+    runtimes.min AS runtime_min,
+    runtimes.avg AS runtime_avg,
+    runtimes.median AS runtime_median,
+    runtimes.max AS runtime_max,
+    NOW() AS refreshed_at
+FROM (
+    SELECT coalesce(min(runtime), 0) AS min,
+        coalesce(avg(runtime), 0)::float8 AS avg,
+        coalesce(percentile_cont(0.5) WITHIN GROUP (ORDER BY runtime), 0)::float8 AS median,
+        coalesce(max(runtime), 0) AS max
+    FROM movies
+    WHERE deleted_at IS NULL AND runtime <> 0
+) AS runtimes;
+
+-- REFRESH MATERIALIZED VIEW CONCURRENTLY needs a unique index.
+CREATE UNIQUE INDEX IF NOT EXISTS movie_stats_id_idx ON movie_stats (id);